@@ -0,0 +1,287 @@
+package app
+
+import (
+	"github.com/spf13/afero"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Backend stores objects by slash separated keys. List works like an S3
+// listing with a "/" delimiter: it reports objects whose keys start with
+// prefix and does not descend into deeper "directories".
+// Missing keys are reported with ErrNotFound.
+type Backend interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (Object, error)
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string, fn func(ObjectInfo) error) error
+}
+
+const readDirBatch = 256
+
+// fsTempDir keeps the files of the fs backend while they are written, they
+// are renamed into place once complete so readers never see partial ones.
+const fsTempDir = ".tmp"
+
+// renamer is a backend that moves objects without the data passing
+// through the service, moveObject copies them on the others.
+type renamer interface {
+	// Rename moves from to to, replacing to. A missing from is
+	// ErrNotFound.
+	Rename(from, to string) error
+}
+
+// moveObject renames from to to, or copies and deletes it when the backend
+// can not rename.
+func moveObject(b Backend, from, to string) error {
+	if r, ok := b.(renamer); ok {
+		return r.Rename(from, to)
+	}
+	obj, err := b.Get(from)
+	if err != nil {
+		return err
+	}
+	err = b.Put(to, obj)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+	return b.Delete(from)
+}
+
+// tempRemover is a backend with partial writes of its own that may be left
+// behind by a crash.
+type tempRemover interface {
+	// RemoveTemp removes the partial writes last modified before before.
+	RemoveTemp(before time.Time) error
+}
+
+type fsBackend struct {
+	fs   afero.Fs
+	root string
+}
+
+func NewFsBackend(fs afero.Fs, root string) Backend {
+	return fsBackend{
+		fs:   fs,
+		root: root,
+	}
+}
+
+// Put writes r to a temporary file, syncs it and renames it to key. A
+// failed write leaves the old content of key as it was.
+func (b fsBackend) Put(key string, r io.Reader) error {
+	p := b.path(key)
+	if err := b.fs.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(b.root, fsTempDir)
+	if err := b.fs.MkdirAll(tmpDir, 0777); err != nil {
+		return err
+	}
+	to, err := afero.TempFile(b.fs, tmpDir, "put-")
+	if err != nil {
+		return err
+	}
+	if err := b.write(to, r); err != nil {
+		b.fs.Remove(to.Name())
+		return err
+	}
+	if err := b.fs.Rename(to.Name(), p); err != nil {
+		b.fs.Remove(to.Name())
+		return err
+	}
+	return nil
+}
+
+func (b fsBackend) write(to afero.File, r io.Reader) error {
+	if _, err := io.Copy(to, r); err != nil {
+		to.Close()
+		return err
+	}
+	if err := to.Sync(); err != nil {
+		to.Close()
+		return err
+	}
+	return to.Close()
+}
+
+// Rename moves the file of from, which Put has already synced.
+func (b fsBackend) Rename(from, to string) error {
+	p := b.path(to)
+	if err := b.fs.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	err := b.fs.Rename(b.path(from), p)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b fsBackend) RemoveTemp(before time.Time) error {
+	infos, err := afero.ReadDir(b.fs, filepath.Join(b.root, fsTempDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !info.ModTime().Before(before) {
+			continue
+		}
+		err := b.fs.Remove(filepath.Join(b.root, fsTempDir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b fsBackend) Get(key string) (Object, error) {
+	f, err := b.fs.Open(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+func (b fsBackend) Stat(key string) (ObjectInfo, error) {
+	stat, err := b.fs.Stat(b.path(key))
+	if os.IsNotExist(err) || (err == nil && stat.IsDir()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:      key,
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+	}, nil
+}
+
+func (b fsBackend) Delete(key string) error {
+	err := b.fs.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b fsBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	dir, base := path.Split(prefix)
+	f, err := b.fs.Open(b.path(dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		infos, err := f.Readdir(readDirBatch)
+		for _, info := range infos {
+			if info.IsDir() || !strings.HasPrefix(info.Name(), base) {
+				continue
+			}
+			err := fn(ObjectInfo{
+				Key:      dir + info.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || (err == nil && len(infos) == 0) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b fsBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+// storageBackend reports the failures of a backend as ErrStorage, errors
+// with a kind, like ErrNotFound or a limit hit while reading, stay as they
+// are.
+type storageBackend struct {
+	Backend
+}
+
+func (b storageBackend) Put(key string, r io.Reader) error {
+	return ErrStorage.wrap(b.Backend.Put(key, r))
+}
+
+func (b storageBackend) Get(key string) (Object, error) {
+	obj, err := b.Backend.Get(key)
+	return obj, ErrStorage.wrap(err)
+}
+
+func (b storageBackend) Stat(key string) (ObjectInfo, error) {
+	info, err := b.Backend.Stat(key)
+	return info, ErrStorage.wrap(err)
+}
+
+func (b storageBackend) Delete(key string) error {
+	return ErrStorage.wrap(b.Backend.Delete(key))
+}
+
+func (b storageBackend) Rename(from, to string) error {
+	return ErrStorage.wrap(moveObject(b.Backend, from, to))
+}
+
+func (b storageBackend) RemoveTemp(before time.Time) error {
+	if r, ok := b.Backend.(tempRemover); ok {
+		return ErrStorage.wrap(r.RemoveTemp(before))
+	}
+	return nil
+}
+
+// List returns the errors of fn as they are, they stop the listing.
+func (b storageBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	var stop error
+	err := b.Backend.List(prefix, func(info ObjectInfo) error {
+		stop = fn(info)
+		return stop
+	})
+	if err != nil && err == stop {
+		return err
+	}
+	return ErrStorage.wrap(err)
+}
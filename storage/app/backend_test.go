@@ -0,0 +1,165 @@
+package app
+
+import (
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testBackends(t *testing.T) (map[string]Backend, func()) {
+	server := httptest.NewServer(newFakeS3("bucket"))
+	s3, err := NewS3Backend(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, server.Client())
+	assert.Nil(t, err)
+
+	return map[string]Backend{
+		"fs": NewFsBackend(afero.NewMemMapFs(), "/images"),
+		"s3": s3,
+	}, server.Close
+}
+
+func TestBackendPutGet(t *testing.T) {
+	backends, done := testBackends(t)
+	defer done()
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, b.Put("a.png", strings.NewReader("longer content")))
+			assert.Nil(t, b.Put("a.png", strings.NewReader("content")))
+
+			info, err := b.Stat("a.png")
+			assert.Nil(t, err)
+			assert.Equal(t, int64(7), info.Size)
+			assert.False(t, info.Modified.IsZero())
+
+			obj, err := b.Get("a.png")
+			assert.Nil(t, err)
+			defer obj.Close()
+			obj.Seek(3, io.SeekStart)
+			rest, err := ioutil.ReadAll(obj)
+			assert.Nil(t, err)
+			assert.Equal(t, "tent", string(rest))
+			obj.Seek(0, io.SeekStart)
+			all, err := ioutil.ReadAll(obj)
+			assert.Nil(t, err)
+			assert.Equal(t, "content", string(all))
+
+			_, err = b.Get("missing.png")
+			assert.Equal(t, ErrNotFound, err)
+			_, err = b.Stat("missing.png")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func TestBackendDelete(t *testing.T) {
+	backends, done := testBackends(t)
+	defer done()
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, b.Put("a.png", strings.NewReader("content")))
+			assert.Nil(t, b.Delete("a.png"))
+			_, err := b.Stat("a.png")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func TestBackendRename(t *testing.T) {
+	backends, done := testBackends(t)
+	defer done()
+	// moveObject copies on backends that can not rename
+	backends["copy"] = struct{ Backend }{NewFsBackend(afero.NewMemMapFs(), "/images")}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, b.Put("tmp/a", strings.NewReader("content")))
+			assert.Nil(t, moveObject(b, "tmp/a", "blobs/ab/a"))
+			_, err := b.Stat("tmp/a")
+			assert.Equal(t, ErrNotFound, err)
+			obj, err := b.Get("blobs/ab/a")
+			assert.Nil(t, err)
+			content, err := ioutil.ReadAll(obj)
+			obj.Close()
+			assert.Nil(t, err)
+			assert.Equal(t, "content", string(content))
+
+			assert.Equal(t, ErrNotFound, moveObject(b, "tmp/missing", "blobs/ab/b"))
+		})
+	}
+}
+
+func TestBackendList(t *testing.T) {
+	cases := []struct {
+		prefix string
+		keys   []string
+	}{
+		{"", []string{"a.png", "b.png", "c.jpg", "d.png"}},
+		{"a", []string{"a.png"}},
+		{"dir/", []string{"dir/e.png"}},
+		{"none/", nil},
+	}
+
+	backends, done := testBackends(t)
+	defer done()
+	for name, b := range backends {
+		for _, key := range []string{"a.png", "b.png", "c.jpg", "d.png", "dir/e.png"} {
+			assert.Nil(t, b.Put(key, strings.NewReader(key)))
+		}
+		for i, tc := range cases {
+			t.Run(fmt.Sprintf("%s case %d", name, i), func(t *testing.T) {
+				var keys []string
+				err := b.List(tc.prefix, func(info ObjectInfo) error {
+					assert.Equal(t, int64(len(info.Key)), info.Size)
+					keys = append(keys, info.Key)
+					return nil
+				})
+				assert.Nil(t, err)
+				sort.Strings(keys)
+				assert.Equal(t, tc.keys, keys)
+			})
+		}
+	}
+}
+
+func TestFsBackendAtomicPut(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	b := NewFsBackend(fs, "/images").(fsBackend)
+	assert.Nil(t, b.Put("a.png", strings.NewReader("content")))
+
+	// a failed write keeps the old content and leaves nothing behind
+	err := b.Put("a.png", iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("partial"))))
+	assert.Equal(t, iotest.ErrTimeout, err)
+	obj, err := b.Get("a.png")
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	assert.Equal(t, "content", string(content))
+	temps, err := afero.ReadDir(fs, "/images/"+fsTempDir)
+	assert.Nil(t, err)
+	assert.Len(t, temps, 0)
+
+	// only temporary files older than the given time are removed
+	now := time.Now()
+	assert.Nil(t, afero.WriteFile(fs, "/images/.tmp/put-1", []byte("old"), 0666))
+	assert.Nil(t, fs.Chtimes("/images/.tmp/put-1", now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	assert.Nil(t, afero.WriteFile(fs, "/images/.tmp/put-2", []byte("new"), 0666))
+	assert.Nil(t, b.RemoveTemp(now.Add(-time.Hour)))
+	_, err = fs.Stat("/images/.tmp/put-1")
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.Stat("/images/.tmp/put-2")
+	assert.Nil(t, err)
+
+	assert.Nil(t, NewFsBackend(afero.NewMemMapFs(), "/empty").(fsBackend).RemoveTemp(now))
+}
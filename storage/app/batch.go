@@ -0,0 +1,140 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+var ErrAtomicOverwrite = newError(http.StatusBadRequest, "atomic_overwrite", "atomic uploads can not overwrite files, set collision to reject or rename")
+
+// uploadBatch saves the files of one upload request and reports each of
+// them. In atomic mode the first failure stops the batch and the files it
+// created are removed again when it responds.
+type uploadBatch struct {
+	service *service
+	atomic  bool
+	results []UploadResultDTO
+	created []int
+	failed  int
+}
+
+func newUploadBatch(s *service, atomic bool) *uploadBatch {
+	return &uploadBatch{service: s, atomic: atomic, failed: -1}
+}
+
+// stopped tells an atomic batch to skip the rest of the files.
+func (b *uploadBatch) stopped() bool {
+	return b.atomic && b.failed >= 0
+}
+
+func (b *uploadBatch) skip(name string) {
+	b.results = append(b.results, UploadResultDTO{
+		Name:   name,
+		Status: http.StatusFailedDependency,
+		Code:   "skipped",
+		Error:  "not saved, another file failed",
+	})
+}
+
+// reject fails name with the status and code of err.
+func (b *uploadBatch) reject(name string, err error) {
+	if b.failed < 0 {
+		b.failed = len(b.results)
+	}
+	p := problem(err)
+	b.results = append(b.results, UploadResultDTO{Name: name, Status: p.Status, Code: p.Code, Error: p.detail()})
+}
+
+// save stores upload with its variants and reports it.
+func (b *uploadBatch) save(upload File) {
+	name := upload.Name
+	info, variants, err := b.service.saveUpload(upload)
+	if err != nil {
+		b.reject(name, err)
+		return
+	}
+	dto := b.service.fileDTO(info, variants)
+	if info.Created {
+		b.created = append(b.created, len(b.results))
+	}
+	b.results = append(b.results, UploadResultDTO{Name: name, Status: http.StatusOK, File: &dto})
+}
+
+// saveReader sniffs the type from the head of r and saves upload from it.
+func (b *uploadBatch) saveReader(upload File, r io.Reader) {
+	content := bufio.NewReaderSize(r, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		b.reject(upload.Name, badRequest(fmt.Sprintf("could not read file: %s", err.Error())))
+		return
+	}
+	upload.Type = detectType(head)
+	upload.Content = content
+	b.save(upload)
+}
+
+// saveUpload streams upload to the storage and makes its variants from the
+// stored file. A file whose variants can not be made is removed again when
+// it was created, so a failed upload leaves nothing behind.
+func (s service) saveUpload(upload File) (FileInfo, map[string]string, error) {
+	info, err := s.SaveStream(upload)
+	if err != nil {
+		return FileInfo{}, nil, err
+	}
+	variants, err := s.storedVariants(info, upload.Quality)
+	if err != nil {
+		if info.Created {
+			s.Delete(info.Name)
+		}
+		return FileInfo{}, nil, err
+	}
+	return info, variants, nil
+}
+
+func (s service) storedVariants(info FileInfo, quality int) (map[string]string, error) {
+	f, _, err := s.Open(info.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return s.Variants(File{
+		Name:    info.Name,
+		Size:    int(info.Size),
+		Type:    info.Type,
+		Content: f,
+		Quality: quality,
+	})
+}
+
+// respond writes the results. A failed atomic batch is rolled back and
+// answered with the status of the failed file.
+func (b *uploadBatch) respond(c *gin.Context) {
+	if !b.stopped() {
+		c.JSON(http.StatusOK, b.results)
+		return
+	}
+
+	failed := b.results[b.failed]
+	err := &Error{
+		Status:  failed.Status,
+		Code:    failed.Code,
+		Message: fmt.Sprintf("no files saved, %s: %s", failed.Name, failed.Error),
+	}
+	for _, i := range b.created {
+		result := &b.results[i]
+		if _, derr := b.service.Delete(result.File.Name); derr != nil {
+			err = ErrStorage.with(fmt.Sprintf("could not roll back %s: %s", result.File.Name, derr.Error()))
+			result.Code = ErrStorage.Code
+			result.Error = fmt.Sprintf("could not roll back: %s", derr.Error())
+			continue
+		}
+		result.Status = http.StatusFailedDependency
+		result.File = nil
+		result.Code = "rolled_back"
+		result.Error = "rolled back, another file failed"
+	}
+	problemResponse(c, err, gin.H{"results": b.results})
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	json2 "encoding/json"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content is stored once per SHA-256 under blobs/, names point at it
+// through refs/<name>, and links/<hash>/<name> markers record which names
+// use a blob, so it can be collected when the last one goes away. The
+// variants of a name have their refs under variants/<name>/<variant> and a
+// kept source under sources/<name>, apart from uploads, their links are
+// named <variant>:<name>. Stored names never hold a ':', so neither clash
+// with an upload.
+//
+// Names and hashes are locked within the service: a name is claimed,
+// overwritten or deleted by one request at a time, and a blob is stored
+// and linked without a collect in between. The locks do not reach other
+// processes. S3 has no locks or conditional writes to build shared ones
+// on, so instances sharing a bucket, or an fs root, can still lose a blob
+// to the delete of another instance or both create the same new name.
+// Run one writing instance per backend where that matters.
+const (
+	blobsPrefix = "blobs/"
+	refsPrefix  = "refs/"
+	linksPrefix = "links/"
+	// variantsPrefix and sourcesPrefix hold the refs of derivatives
+	variantsPrefix = "variants/"
+	sourcesPrefix  = "sources/"
+	// tmpPrefix holds streamed uploads until their hash is known
+	tmpPrefix = "tmp/"
+)
+
+type ref struct {
+	Hash string `json:"hash"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+func blobKey(hash string) string {
+	return blobsPrefix + hash[:2] + "/" + hash
+}
+
+func refKey(name string) string {
+	return refsPrefix + name
+}
+
+// refName is where a ref is stored and the name it links its blob with.
+type refName struct {
+	key  string
+	link string
+}
+
+func fileRef(name string) refName {
+	return refName{key: refKey(name), link: name}
+}
+
+func derivativeRef(name, variant string) refName {
+	link := variant + ":" + name
+	if variant == sourceVariant {
+		return refName{key: sourcesPrefix + name, link: link}
+	}
+	return refName{key: variantsPrefix + name + "/" + variant, link: link}
+}
+
+func linkKey(hash, name string) string {
+	return linksPrefix + hash + "/" + name
+}
+
+// lockStripes is the number of mutexes names and hashes are spread over.
+const lockStripes = 64
+
+// stripedLocks lock keys with a fixed set of mutexes. Keys sharing one
+// wait for each other, which is rare and only costs time.
+type stripedLocks struct {
+	mu [lockStripes]sync.Mutex
+}
+
+// lock locks key and returns the function unlocking it.
+func (l *stripedLocks) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l.mu[h.Sum32()%lockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func contentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s service) putBlob(hash string, b []byte) error {
+	_, err := s.backend.Stat(blobKey(hash))
+	if err == ErrNotFound {
+		return s.backend.Put(blobKey(hash), bytes.NewReader(b))
+	}
+	return err
+}
+
+// linkBlob stores the blob of r with put and links rn to it. The lock of
+// the hash keeps collect from removing the blob before the link is there.
+func (s service) linkBlob(rn refName, r ref, put func() error) error {
+	defer s.hashes.lock(r.Hash)()
+	if err := put(); err != nil {
+		return err
+	}
+	return s.link(rn, r)
+}
+
+// putTemp streams content to a temporary object, hashing it on the way.
+// Nothing is left behind when it fails.
+func (s service) putTemp(content io.Reader) (key, hash string, size int64, err error) {
+	key = tmpPrefix + newUUID()
+	s.drain.writing(key)
+	h := sha256.New()
+	if err := s.backend.Put(key, io.TeeReader(content, h)); err != nil {
+		s.dropTemp(key)
+		return "", "", 0, err
+	}
+	info, err := s.backend.Stat(key)
+	if err != nil {
+		s.dropTemp(key)
+		return "", "", 0, err
+	}
+	return key, hex.EncodeToString(h.Sum(nil)), info.Size, nil
+}
+
+func (s service) dropTemp(key string) {
+	s.backend.Delete(key)
+	s.drain.written(key)
+}
+
+// removeStale removes the temporary objects and partial writes modified
+// before before, the ones left by uploads cut off by a crash.
+func (s service) removeStale(before time.Time) error {
+	var keys []string
+	err := s.backend.List(tmpPrefix, func(info ObjectInfo) error {
+		if info.Modified.Before(before) {
+			keys = append(keys, info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.backend.Delete(key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	if r, ok := s.backend.(tempRemover); ok {
+		return r.RemoveTemp(before)
+	}
+	return nil
+}
+
+// promote turns a temporary object into the blob of hash, it is moved
+// there unless the blob exists already.
+func (s service) promote(key, hash string) error {
+	_, err := s.backend.Stat(blobKey(hash))
+	if err == ErrNotFound {
+		return moveObject(s.backend, key, blobKey(hash))
+	}
+	if err != nil {
+		return err
+	}
+	return s.backend.Delete(key)
+}
+
+func (s service) readRef(rn refName) (ref, error) {
+	obj, err := s.backend.Get(rn.key)
+	if err != nil {
+		return ref{}, err
+	}
+	defer obj.Close()
+
+	var r ref
+	if err := json2.NewDecoder(obj).Decode(&r); err != nil {
+		return ref{}, err
+	}
+	return r, nil
+}
+
+func (s service) link(rn refName, r ref) error {
+	if err := s.backend.Put(linkKey(r.Hash, rn.link), strings.NewReader("")); err != nil {
+		return err
+	}
+	b, err := json2.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.backend.Put(rn.key, bytes.NewReader(b))
+}
+
+func (s service) unlink(rn refName) error {
+	defer s.names.lock(rn.key)()
+	r, err := s.readRef(rn)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Delete(rn.key); err != nil {
+		return err
+	}
+	return s.release(r.Hash, rn.link)
+}
+
+// release drops the link named link to the blob and removes the blob once
+// nothing links to it anymore.
+func (s service) release(hash, link string) error {
+	err := s.backend.Delete(linkKey(hash, link))
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	return s.collect(hash)
+}
+
+func (s service) collect(hash string) error {
+	defer s.hashes.lock(hash)()
+	linked := false
+	err := s.backend.List(linksPrefix+hash+"/", func(ObjectInfo) error {
+		linked = true
+		return io.EOF
+	})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if linked {
+		return nil
+	}
+	err = s.backend.Delete(blobKey(hash))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,352 @@
+package app
+
+import (
+	json2 "encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/spf13/afero"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is what the server is started with. LoadConfig takes it from the
+// defaults, a JSON file, the environment and flags, each of them
+// overriding the ones before.
+type Config struct {
+	Listen string
+	// ShutdownTimeout is how long uploads in flight may take to finish on
+	// shutdown
+	ShutdownTimeout time.Duration
+	// Root is the directory of the fs backend, PublicPath the URL path the
+	// files are served under
+	Root       string
+	PublicPath string
+	// Uploads keeps unfinished uploads, <Root>/tus when empty
+	Uploads string
+	// Backend is fs, s3 or memory
+	Backend string
+	S3      S3Config
+	// Options without Fetcher and Uploads, they are made from Fetch and
+	// Uploads
+	Options Options
+	Fetch   FetcherOptions
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 20 * time.Second,
+		Root:            "/images",
+		PublicPath:      "/images",
+		Backend:         "fs",
+		Options:         Options{Limits: DefaultLimits, UploadExpiry: DefaultUploadExpiry},
+		Fetch:           DefaultFetcherOptions,
+	}
+}
+
+// staleTempAge is the age of temporary files removed on start, uploads
+// cut off by a crash left them.
+const staleTempAge = time.Hour
+
+// setting is a configuration value, key in the file, KEY in the
+// environment and -key with dashes as a flag.
+type setting struct {
+	key   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "address to listen on", func(c *Config, v string) error {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return errors.New("should be host:port")
+		}
+		c.Listen = v
+		return nil
+	}},
+	{"shutdown_timeout", "time uploads in flight get to finish on shutdown", func(c *Config, v string) error {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return errors.New("should be a duration")
+		}
+		c.ShutdownTimeout = timeout
+		return nil
+	}},
+	{"storage_root", "directory of the fs backend", stringSetting(func(c *Config) *string { return &c.Root })},
+	{"public_path", "URL path files are served under", func(c *Config, v string) error {
+		if !strings.HasPrefix(v, "/") {
+			return errors.New("should start with /")
+		}
+		c.PublicPath = path.Clean(v)
+		return nil
+	}},
+	{"uploads_dir", "directory of unfinished uploads", stringSetting(func(c *Config) *string { return &c.Uploads })},
+	{"upload_expiry", "time unfinished uploads are kept", func(c *Config, v string) error {
+		expiry, err := time.ParseDuration(v)
+		if err != nil || expiry <= 0 {
+			return errors.New("should be a positive duration")
+		}
+		c.Options.UploadExpiry = expiry
+		return nil
+	}},
+	{"storage_backend", "fs, s3 or memory", func(c *Config, v string) error {
+		switch v {
+		case "fs", "s3", "memory":
+			c.Backend = v
+			return nil
+		}
+		return errors.New("should be one of fs, s3, memory")
+	}},
+	{"s3_endpoint", "S3 endpoint URL", stringSetting(func(c *Config) *string { return &c.S3.Endpoint })},
+	{"s3_region", "S3 region", stringSetting(func(c *Config) *string { return &c.S3.Region })},
+	{"s3_bucket", "S3 bucket", stringSetting(func(c *Config) *string { return &c.S3.Bucket })},
+	{"s3_access_key", "S3 access key", stringSetting(func(c *Config) *string { return &c.S3.AccessKey })},
+	{"s3_secret_key", "S3 secret key", stringSetting(func(c *Config) *string { return &c.S3.SecretKey })},
+	{"thumbnail_variants", "variants made for every upload, name:WxH[:fit[:quality]],...", func(c *Config, v string) (err error) {
+		c.Options.Variants, err = ParseVariants(v)
+		return err
+	}},
+	{"transform_sizes", "allowed sizes of on the fly transforms", func(c *Config, v string) (err error) {
+		c.Options.TransformSizes, err = ParseSizes(v)
+		return err
+	}},
+	{"transform_qualities", "allowed qualities of on the fly transforms", func(c *Config, v string) (err error) {
+		c.Options.TransformQualities, err = ParseQualities(v)
+		return err
+	}},
+	{"target_format", "type uploads are converted to", func(c *Config, v string) (err error) {
+		c.Options.Format, err = ParseFormat(v)
+		return err
+	}},
+	{"target_quality", "quality of converted uploads and variants", func(c *Config, v string) (err error) {
+		c.Options.Quality, err = ParseQuality(v)
+		return err
+	}},
+	{"keep_source", "keep the original of converted uploads", boolSetting(func(c *Config) *bool { return &c.Options.KeepSource })},
+	{"strip_metadata", "remove metadata from uploads", boolSetting(func(c *Config) *bool { return &c.Options.StripMetadata })},
+	{"normalize_orientation", "rotate uploads upright", boolSetting(func(c *Config) *bool { return &c.Options.NormalizeOrientation })},
+	{"max_width", "widest accepted image", intSetting(1, func(c *Config) *int { return &c.Options.Limits.MaxWidth })},
+	{"max_height", "highest accepted image", intSetting(1, func(c *Config) *int { return &c.Options.Limits.MaxHeight })},
+	{"max_pixels", "most pixels of an accepted image", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return errors.New("should be a positive number")
+		}
+		c.Options.Limits.MaxPixels = n
+		return nil
+	}},
+	{"max_bytes", "largest accepted file, may end in K, M or G", func(c *Config, v string) (err error) {
+		c.Options.Limits.MaxBytes, err = ParseBytes(v)
+		return err
+	}},
+	{"fetch_timeout", "time limit of downloading a linked file", func(c *Config, v string) error {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return errors.New("should be a positive duration")
+		}
+		c.Fetch.Timeout = timeout
+		return nil
+	}},
+	{"fetch_max_redirects", "redirects followed for a linked file", intSetting(0, func(c *Config) *int { return &c.Fetch.MaxRedirects })},
+	{"fetch_allow", "private networks linked files may come from, comma separated", func(c *Config, v string) error {
+		allow := strings.Split(v, ",")
+		if _, err := parseCIDRList(allow); err != nil {
+			return err
+		}
+		c.Fetch.Allow = allow
+		return nil
+	}},
+	{"fetch_insecure_skip_verify", "skip TLS verification of linked files", boolSetting(func(c *Config) *bool { return &c.Fetch.InsecureSkipVerify })},
+	{"fetch_workers", "concurrent downloads of a links import", intSetting(1, func(c *Config) *int { return &c.Fetch.Workers })},
+	{"fetch_max_urls", "most urls of a links import", intSetting(1, func(c *Config) *int { return &c.Fetch.MaxURLs })},
+	{"fetch_import_timeout", "time limit of a whole links import", func(c *Config, v string) error {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return errors.New("should be a positive duration")
+		}
+		c.Fetch.ImportTimeout = timeout
+		return nil
+	}},
+}
+
+func stringSetting(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func boolSetting(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("should be true or false")
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func intSetting(min int, field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min {
+			return fmt.Errorf("should be a number of at least %d", min)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func envName(key string) string {
+	return strings.ToUpper(key)
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// LoadConfig reads the config file named by -config or CONFIG_FILE, then
+// the environment, then the other flags in args. getenv looks the
+// environment up, os.Getenv for the real one.
+func LoadConfig(args []string, getenv func(string) string) (Config, error) {
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("storage", flag.ContinueOnError)
+	file := flags.String("config", getenv("CONFIG_FILE"), "JSON config file, CONFIG_FILE")
+	byFlag := map[string]setting{}
+	for _, s := range settings {
+		flags.String(flagName(s.key), "", fmt.Sprintf("%s, %s", s.usage, envName(s.key)))
+		byFlag[flagName(s.key)] = s
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *file != "" {
+		if err := config.loadFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		if v := getenv(envName(s.key)); v != "" {
+			if err := config.apply(s, v, "env "+envName(s.key)); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok && err == nil {
+			err = config.apply(s, f.Value.String(), "flag -"+f.Name)
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+	return config, config.validate()
+}
+
+// loadFile reads a JSON object of settings, values may be strings, numbers
+// or booleans.
+func (c *Config) loadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("could not read config: %s", err.Error())
+	}
+	defer f.Close()
+	var values map[string]interface{}
+	decoder := json2.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	byKey := map[string]setting{}
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	for key, value := range values {
+		s, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", name, key)
+		}
+		switch value.(type) {
+		case string, json2.Number, bool:
+		default:
+			return fmt.Errorf("%s: %s should be a string, number or boolean", name, key)
+		}
+		if err := c.apply(s, fmt.Sprint(value), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) apply(s setting, value, source string) error {
+	if err := s.set(c, value); err != nil {
+		return fmt.Errorf("%s: bad %s %q: %s", source, s.key, value, err.Error())
+	}
+	return nil
+}
+
+// validate checks the settings that depend on each other.
+func (c Config) validate() error {
+	switch {
+	case c.Backend == "s3" && c.S3.Bucket == "":
+		return errors.New("storage_backend s3 needs s3_bucket")
+	case c.Backend == "fs" && !path.IsAbs(c.Root):
+		return fmt.Errorf("storage_root %q should be an absolute path", c.Root)
+	}
+	return nil
+}
+
+// NewService makes the backend and the service the config describes.
+// Directories of the fs backend and of unfinished uploads are created.
+func (c Config) NewService() (*service, error) {
+	options := c.Options
+	options.PublicPath = c.PublicPath
+	fetch := c.Fetch
+	fetch.MaxBytes = options.Limits.MaxBytes
+	fetcher, err := NewFetcher(fetch)
+	if err != nil {
+		return nil, err
+	}
+	options.Fetcher = fetcher
+
+	var backend Backend
+	switch c.Backend {
+	case "memory":
+		return NewService(NewFsBackend(afero.NewMemMapFs(), c.Root), options), nil
+	case "s3":
+		if backend, err = NewS3Backend(c.S3, nil); err != nil {
+			return nil, err
+		}
+	default:
+		if err := os.MkdirAll(c.Root, 0777); err != nil {
+			return nil, fmt.Errorf("could not create storage root: %s", err.Error())
+		}
+		backend = NewFsBackend(afero.NewOsFs(), c.Root)
+	}
+
+	uploads := c.Uploads
+	if uploads == "" {
+		uploads = path.Join(c.Root, "tus")
+	}
+	if err := os.MkdirAll(uploads, 0777); err != nil {
+		return nil, fmt.Errorf("could not create uploads dir: %s", err.Error())
+	}
+	options.Uploads = afero.NewBasePathFs(afero.NewOsFs(), uploads)
+	s := NewService(backend, options)
+	// newer ones may be written by another instance on the same backend
+	if err := s.removeStale(time.Now().Add(-staleTempAge)); err != nil {
+		return nil, fmt.Errorf("could not remove temporary files: %s", err.Error())
+	}
+	if err := s.removeExpired(time.Now()); err != nil {
+		return nil, fmt.Errorf("could not remove expired uploads: %s", err.Error())
+	}
+	return s, nil
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	name := path.Join(dir, "config.json")
+	assert.Nil(t, ioutil.WriteFile(name, []byte(content), 0644))
+	return name
+}
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfig(t, `{"listen": "127.0.0.1:9000", "max_width": 500, "max_height": 400, "strip_metadata": true, "fetch_timeout": "5s", "shutdown_timeout": "1m"}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	config, err := LoadConfig(nil, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+
+	// flags override the environment, the environment overrides the file
+	config, err = LoadConfig([]string{"-config", file, "-max-height", "300"}, env(map[string]string{
+		"MAX_WIDTH":    "600",
+		"MAX_HEIGHT":   "200",
+		"STORAGE_ROOT": "/data",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:9000", config.Listen)
+	assert.Equal(t, "/data", config.Root)
+	assert.Equal(t, 600, config.Options.Limits.MaxWidth)
+	assert.Equal(t, 300, config.Options.Limits.MaxHeight)
+	assert.Equal(t, DefaultLimits.MaxBytes, config.Options.Limits.MaxBytes)
+	assert.True(t, config.Options.StripMetadata)
+	assert.Equal(t, 5*time.Second, config.Fetch.Timeout)
+	assert.Equal(t, time.Minute, config.ShutdownTimeout)
+
+	// the file may come from the environment
+	config, err = LoadConfig(nil, env(map[string]string{"CONFIG_FILE": file}))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, config.Options.Limits.MaxWidth)
+
+	config, err = LoadConfig([]string{"-thumbnail-variants", "thumb:100x100,small:64x64:cover", "-public-path", "/files/"}, env(nil))
+	assert.Nil(t, err)
+	assert.Len(t, config.Options.Variants, 2)
+	assert.Equal(t, "/files", config.PublicPath)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		file string
+		args []string
+		env  map[string]string
+		err  string
+	}{
+		{"", []string{"-listen", "8080"}, nil, `flag -listen: bad listen "8080": should be host:port`},
+		{"", nil, map[string]string{"MAX_WIDTH": "0"}, `env MAX_WIDTH: bad max_width "0": should be a number of at least 1`},
+		{"", nil, map[string]string{"STORAGE_BACKEND": "ftp"}, `env STORAGE_BACKEND: bad storage_backend "ftp": should be one of fs, s3, memory`},
+		{"", nil, map[string]string{"KEEP_SOURCE": "maybe"}, `env KEEP_SOURCE: bad keep_source "maybe": should be true or false`},
+		{"", []string{"-fetch-timeout", "-1s"}, nil, `flag -fetch-timeout: bad fetch_timeout "-1s": should be a positive duration`},
+		{"", nil, map[string]string{"SHUTDOWN_TIMEOUT": "soon"}, `env SHUTDOWN_TIMEOUT: bad shutdown_timeout "soon": should be a duration`},
+		{"", []string{"-storage-backend", "s3"}, nil, "storage_backend s3 needs s3_bucket"},
+		{"", []string{"-storage-root", "images"}, nil, `storage_root "images" should be an absolute path`},
+		{"", []string{"-public-path", "images"}, nil, `flag -public-path: bad public_path "images": should start with /`},
+		{`{"max_bytes": "lots"}`, nil, nil, `bad max_bytes "lots"`},
+		{`{"thumbnail_size": 100}`, nil, nil, `unknown setting "thumbnail_size"`},
+		{`{"fetch_allow": ["10.0.0.0/8"]}`, nil, nil, "fetch_allow should be a string, number or boolean"},
+		{`not json`, nil, nil, "invalid character"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			args := tc.args
+			if tc.file != "" {
+				file := writeConfig(t, tc.file)
+				defer os.RemoveAll(path.Dir(file))
+				args = append([]string{"-config", file}, args...)
+			}
+			_, err := LoadConfig(args, env(tc.env))
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+
+	_, err := LoadConfig([]string{"-config", "/nonexistent/config.json"}, env(nil))
+	assert.NotNil(t, err)
+}
+
+func TestConfigNewService(t *testing.T) {
+	config := DefaultConfig()
+	config.Backend = "memory"
+	config.PublicPath = "/files"
+	s, err := config.NewService()
+	assert.Nil(t, err)
+	assert.Equal(t, "/files/a.png", s.path("a.png"))
+
+	dir, err := ioutil.TempDir("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	config = DefaultConfig()
+	config.Root = path.Join(dir, "images")
+	_, err = config.NewService()
+	assert.Nil(t, err)
+	_, err = os.Stat(path.Join(dir, "images", "tus"))
+	assert.Nil(t, err)
+}
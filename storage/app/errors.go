@@ -0,0 +1,133 @@
+package app
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// Error is an error the API answers with its own status. Code names the
+// kind of error for clients, errors made with wrap keep their cause in Err.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func newError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Is matches errors of the same kind, so errors.Is finds wrapped ones.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// wrap makes an error of the kind of e caused by err. Errors that already
+// have a kind keep it.
+func (e *Error) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Status: e.Status, Code: e.Code, Message: e.Message, Err: err}
+}
+
+// with is an error of the kind of e with another message.
+func (e *Error) with(message string) *Error {
+	return &Error{Status: e.Status, Code: e.Code, Message: message}
+}
+
+var (
+	ErrBadRequest      = newError(http.StatusBadRequest, "bad_request", "bad request")
+	ErrNotFound        = newError(http.StatusNotFound, "not_found", "file not found")
+	ErrExists          = newError(http.StatusConflict, "exists", "file already exists, set collision to overwrite or rename")
+	ErrTooLarge        = newError(http.StatusRequestEntityTooLarge, "too_large", "file is too large")
+	ErrUnsupportedType = newError(http.StatusUnsupportedMediaType, "unsupported_type", "unsupported file type")
+	ErrBadImage        = newError(http.StatusUnprocessableEntity, "bad_image", "invalid image")
+	ErrLimit           = newError(http.StatusUnprocessableEntity, "limit_exceeded", "image is over the limits")
+	ErrBadTransform    = newError(http.StatusBadRequest, "bad_transform", "bad transform")
+	ErrStorage         = newError(http.StatusInternalServerError, "storage", "storage failure")
+	ErrInternal        = newError(http.StatusInternalServerError, "internal", "internal error")
+	ErrFetch           = newError(http.StatusBadGateway, "fetch", "could not download file")
+)
+
+// badRequest is a validation error of a request.
+func badRequest(message string) *Error {
+	return ErrBadRequest.with(message)
+}
+
+// problem is the API error for err, errors without a kind are internal.
+func problem(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *LimitError:
+		return ErrLimit.with(e.Message)
+	case *TransformError:
+		return ErrBadTransform.with(e.Message)
+	case *StatusError:
+		// the remote status is no detail of this server
+		return ErrFetch.with(ErrFetch.Message + ": " + e.Error())
+	case *DeleteError:
+		return ErrStorage.with("could not delete file: " + e.Error())
+	default:
+		return ErrInternal.wrap(err).(*Error)
+	}
+}
+
+// detail is what clients are told about e. Causes of server failures may
+// hold storage paths or responses, they are logged and clients only get
+// the message of the kind.
+func (e *Error) detail() string {
+	if e.Status < http.StatusInternalServerError {
+		return e.Error()
+	}
+	if e.Err != nil {
+		log.Printf("error: %v\n", e)
+	}
+	return e.Message
+}
+
+// err is the error of a failed upload result.
+func (r UploadResultDTO) err() error {
+	return &Error{Status: r.Status, Code: r.Code, Message: r.Error}
+}
+
+func (r *LinkResultDTO) fail(err error) {
+	p := problem(err)
+	r.Status, r.Code, r.Error = p.Status, p.Code, p.detail()
+}
+
+// problemResponse answers with an RFC 7807 problem for err, extra members
+// are added to it.
+func problemResponse(c *gin.Context, err error, extra gin.H) {
+	p := problem(err)
+	body := gin.H{
+		"type":   "about:blank",
+		"title":  http.StatusText(p.Status),
+		"status": p.Status,
+		"detail": p.detail(),
+		"code":   p.Code,
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(p.Status, body)
+}
+
+func errorResponse(c *gin.Context, mess string) {
+	problemResponse(c, badRequest(mess), nil)
+}
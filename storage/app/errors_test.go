@@ -0,0 +1,79 @@
+package app
+
+import (
+	"bytes"
+	json2 "encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failingBackend fails every write like a full disk.
+type failingBackend struct {
+	Backend
+}
+
+func (b failingBackend) Put(key string, r io.Reader) error {
+	return errors.New("no space left on device")
+}
+
+func TestProblem(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+		detail string
+	}{
+		{ErrNotFound, http.StatusNotFound, "not_found", "file not found"},
+		{ErrUnsupportedType, http.StatusUnsupportedMediaType, "unsupported_type", "unsupported file type"},
+		{ErrStorage.wrap(io.ErrUnexpectedEOF), http.StatusInternalServerError, "storage", "storage failure"},
+		{ErrStorage.wrap(ErrTooLarge), http.StatusRequestEntityTooLarge, "too_large", "file is too large"},
+		{&LimitError{"image is 2000 pixels wide, the limit is 1000"}, http.StatusUnprocessableEntity, "limit_exceeded", "image is 2000 pixels wide, the limit is 1000"},
+		{&TransformError{"unsupported format image/bmp"}, http.StatusBadRequest, "bad_transform", "unsupported format image/bmp"},
+		{&StatusError{Code: 404, Status: "404 Not Found"}, http.StatusBadGateway, "fetch", "could not download file: server responded 404 Not Found"},
+		{badRequest("limit should be a positive number"), http.StatusBadRequest, "bad_request", "limit should be a positive number"},
+		{errors.New("boom"), http.StatusInternalServerError, "internal", "internal error"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			p := problem(tc.err)
+			assert.Equal(t, tc.status, p.Status)
+			assert.Equal(t, tc.code, p.Code)
+			assert.Equal(t, tc.detail, p.detail())
+		})
+	}
+
+	assert.True(t, ErrStorage.wrap(io.EOF).(*Error).Is(ErrStorage))
+	assert.False(t, ErrStorage.wrap(io.EOF).(*Error).Is(ErrFetch))
+	assert.Nil(t, ErrStorage.wrap(nil))
+}
+
+func TestStorageFailure(t *testing.T) {
+	s := NewService(failingBackend{NewFsBackend(afero.NewMemMapFs(), "/images")}, Options{})
+
+	_, err := s.SaveFile(File{
+		Name:    "full.png",
+		Type:    "image/png",
+		Content: bytes.NewReader(testPNG(4, 4)),
+	})
+	assert.Equal(t, ErrStorage.Code, problem(err).Code)
+	_, err = s.Stat("full.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	body := `[{"name":"full.png","size":1,"type":"image/png","content":"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGP4z8DwHwAFAAH/iZk9HQAAAABJRU5ErkJggg=="}]`
+	req, _ := http.NewRequest("POST", "/storage/upload/json", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := performRequest(NewRouter(s), req)
+	var results []UploadResultDTO
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &results))
+	assert.Equal(t, http.StatusInternalServerError, results[0].Status)
+	assert.Equal(t, "storage", results[0].Code)
+	// the cause stays in the log
+	assert.Equal(t, "storage failure", results[0].Error)
+}
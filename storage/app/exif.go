@@ -0,0 +1,427 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"sort"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	exifGPSTag         = 0x8825
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegSegments calls fn for every marker segment before the image data
+// with the marker and the whole segment, marker and length included. It
+// returns the offset of the start of scan, or -1 when it did not get there.
+func jpegSegments(b []byte, fn func(marker byte, segment []byte) bool) int {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return -1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return -1
+		}
+		marker := b[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			i += 2
+			continue
+		}
+		if marker == 0xda {
+			return i
+		}
+		if marker == 0xd9 {
+			return -1
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if length < 2 || i+2+length > len(b) {
+			return -1
+		}
+		if !fn(marker, b[i:i+2+length]) {
+			return -1
+		}
+		i += 2 + length
+	}
+	return -1
+}
+
+// exifTags reads the entries of IFD0 from an APP1 Exif payload and
+// returns the value offsets of the tags asked for, keyed by tag.
+func exifTags(payload []byte, tags ...uint16) map[uint16]uint32 {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return map[uint16]uint32{}
+	}
+	return tiffTags(payload[len(exifHeader):], tags...)
+}
+
+// tiffTags is exifTags for the TIFF structure itself.
+func tiffTags(tiff []byte, tags ...uint16) map[uint16]uint32 {
+	found := map[uint16]uint32{}
+	tiffEntries(tiff, func(order binary.ByteOrder, entry []byte) {
+		tag := order.Uint16(entry[0:2])
+		for _, t := range tags {
+			if tag != t {
+				continue
+			}
+			if order.Uint16(entry[2:4]) == 3 {
+				// SHORT values sit left aligned in the value field
+				found[tag] = uint32(order.Uint16(entry[8:10]))
+			} else {
+				found[tag] = order.Uint32(entry[8:12])
+			}
+		}
+	})
+	return found
+}
+
+// tiffEntries calls fn with the byte order and the 12 bytes of every entry
+// of IFD0 of a TIFF structure.
+func tiffEntries(tiff []byte, fn func(order binary.ByteOrder, entry []byte)) {
+	order := tiffByteOrder(tiff)
+	if order == nil {
+		return
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		fn(order, tiff[entry:entry+12])
+	}
+}
+
+// tiffByteOrder is the byte order of a TIFF structure, nil when it is none.
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// tiffTypeSizes are the sizes of the values of the TIFF field types.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// tiffField is an IFD entry with its value, in the byte order of the TIFF
+// it goes to.
+type tiffField struct {
+	tag, kind uint16
+	count     uint32
+	value     []byte
+}
+
+// tiffFieldOf returns the field tag of IFD0 with its value, or false when
+// it is not there or its value is cut off.
+func tiffFieldOf(tiff []byte, tag uint16) (tiffField, bool) {
+	var field tiffField
+	found := false
+	tiffEntries(tiff, func(order binary.ByteOrder, entry []byte) {
+		if order.Uint16(entry[0:2]) != tag {
+			return
+		}
+		field = tiffField{tag: tag, kind: order.Uint16(entry[2:4]), count: order.Uint32(entry[4:8])}
+		size := int64(tiffTypeSizes[field.kind]) * int64(field.count)
+		if size <= 4 {
+			field.value = append([]byte{}, entry[8:8+size]...)
+			found = true
+			return
+		}
+		offset := int64(order.Uint32(entry[8:12]))
+		if offset+size <= int64(len(tiff)) {
+			field.value = append([]byte{}, tiff[offset:offset+size]...)
+			found = true
+		}
+	})
+	return field, found
+}
+
+// withTIFFFields writes IFD0 of a TIFF again at its end with fields added,
+// their values past four bytes are appended before it. The offsets of the
+// entries it had stay valid.
+func withTIFFFields(tiff []byte, fields ...tiffField) []byte {
+	order := tiffByteOrder(tiff)
+	if order == nil || len(fields) == 0 {
+		return tiff
+	}
+	var entries [][]byte
+	tiffEntries(tiff, func(order binary.ByteOrder, entry []byte) {
+		entries = append(entries, entry)
+	})
+	out := append([]byte{}, tiff...)
+	for _, f := range fields {
+		entry := make([]byte, 12)
+		order.PutUint16(entry[0:2], f.tag)
+		order.PutUint16(entry[2:4], f.kind)
+		order.PutUint32(entry[4:8], f.count)
+		if len(f.value) <= 4 {
+			copy(entry[8:], f.value)
+		} else {
+			// values start on a word boundary
+			if len(out)%2 == 1 {
+				out = append(out, 0)
+			}
+			order.PutUint32(entry[8:12], uint32(len(out)))
+			out = append(out, f.value...)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return order.Uint16(entries[i]) < order.Uint16(entries[j])
+	})
+
+	if len(out)%2 == 1 {
+		out = append(out, 0)
+	}
+	order.PutUint32(out[4:8], uint32(len(out)))
+	count := make([]byte, 2)
+	order.PutUint16(count, uint16(len(entries)))
+	out = append(out, count...)
+	for _, entry := range entries {
+		out = append(out, entry...)
+	}
+	// no next IFD
+	return append(out, 0, 0, 0, 0)
+}
+
+// resetOrientation sets the orientation tag of a TIFF structure to 1 in
+// place.
+func resetOrientation(tiff []byte) {
+	tiffEntries(tiff, func(order binary.ByteOrder, entry []byte) {
+		if order.Uint16(entry[0:2]) == exifOrientationTag && order.Uint16(entry[2:4]) == 3 {
+			order.PutUint16(entry[8:10], 1)
+		}
+	})
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when
+// there is none.
+func jpegOrientation(b []byte) int {
+	orientation := 1
+	jpegSegments(b, func(marker byte, segment []byte) bool {
+		payload := segment[4:]
+		if marker != 0xe1 || !bytes.HasPrefix(payload, exifHeader) {
+			return true
+		}
+		if o, ok := exifTags(payload, exifOrientationTag)[exifOrientationTag]; ok && o >= 1 && o <= 8 {
+			orientation = int(o)
+		}
+		return false
+	})
+	return orientation
+}
+
+// imageOrientation returns the EXIF orientation (1-8) of an image of type
+// mimeType, or 1 when there is none. PNG keeps it in an eXIf chunk, WebP
+// in an EXIF chunk and TIFF in IFD0 of the file itself.
+func imageOrientation(mimeType string, b []byte) int {
+	var tags map[uint16]uint32
+	switch canonicalMimeType(mimeType) {
+	case "image/jpeg":
+		return jpegOrientation(b)
+	case "image/png":
+		pngChunks(b, func(kind string, chunk []byte) {
+			if kind == "eXIf" {
+				tags = tiffTags(chunk[8:len(chunk)-4], exifOrientationTag)
+			}
+		})
+	case "image/webp":
+		webpChunks(b, func(kind string, chunk, payload []byte) {
+			if kind == "EXIF" {
+				tags = tiffTags(bytes.TrimPrefix(payload, exifHeader), exifOrientationTag)
+			}
+		})
+	case "image/tiff":
+		tags = tiffTags(b, exifOrientationTag)
+	}
+	if o, ok := tags[exifOrientationTag]; ok && o >= 1 && o <= 8 {
+		return int(o)
+	}
+	return 1
+}
+
+// normalizable tells whether images of mimeType may carry an orientation
+// and can be encoded again upright. WebP, which is read only, keeps its
+// orientation tag.
+func normalizable(mimeType string) bool {
+	switch canonicalMimeType(mimeType) {
+	case "image/jpeg", "image/png", "image/tiff":
+		return true
+	}
+	return false
+}
+
+// orientationTIFF is a TIFF structure holding nothing but the orientation
+// tag.
+func orientationTIFF(orientation int) []byte {
+	tiff := make([]byte, 26)
+	copy(tiff, "MM")
+	binary.BigEndian.PutUint16(tiff[2:], 42)
+	binary.BigEndian.PutUint32(tiff[4:], 8)
+	binary.BigEndian.PutUint16(tiff[8:], 1)
+	binary.BigEndian.PutUint16(tiff[10:], exifOrientationTag)
+	binary.BigEndian.PutUint16(tiff[12:], 3)
+	binary.BigEndian.PutUint32(tiff[14:], 1)
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	return tiff
+}
+
+// orientationSegment is an APP1 Exif segment holding nothing but the
+// orientation tag.
+func orientationSegment(orientation int) []byte {
+	tiff := orientationTIFF(orientation)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+// orient applies an EXIF orientation so the image is stored upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// normalizeOrientation re-encodes a rotated image upright. The metadata is
+// carried over with the orientation reset, but for TIFF, which keeps its
+// ICC profile only, it returns the kinds of metadata lost.
+func normalizeOrientation(mimeType string, b []byte) ([]byte, []string, error) {
+	orientation := imageOrientation(mimeType, b)
+	if orientation == 1 {
+		return b, nil, nil
+	}
+	if canonicalMimeType(mimeType) == "image/tiff" {
+		out, err := encodeTIFF(b, orientation)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed, _ := tiffMetadata(b)
+		if len(removed) == 0 {
+			return out, nil, nil
+		}
+		return out, sortedKeys(removed), nil
+	}
+	img, err := decodeImage(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	var buff bytes.Buffer
+	if err := encodeImage(&buff, img, mimeType, 95); err != nil {
+		return nil, nil, err
+	}
+	encoded := buff.Bytes()
+
+	switch canonicalMimeType(mimeType) {
+	case "image/jpeg":
+		return carryJPEGMetadata(b, encoded), nil, nil
+	default:
+		return carryPNGMetadata(b, encoded), nil, nil
+	}
+}
+
+// carryJPEGMetadata inserts the application and comment segments of b into
+// the freshly encoded JPEG, but Adobe's, which describes the old encoding.
+func carryJPEGMetadata(b, encoded []byte) []byte {
+	var carried []byte
+	jpegSegments(b, func(marker byte, segment []byte) bool {
+		if marker != 0xfe && (marker < 0xe0 || marker > 0xef || marker == 0xee) {
+			return true
+		}
+		start := len(carried)
+		carried = append(carried, segment...)
+		if marker == 0xe1 && bytes.HasPrefix(segment[4:], exifHeader) {
+			resetOrientation(carried[start+4+len(exifHeader):])
+		}
+		return true
+	})
+	out := append(make([]byte, 0, len(encoded)+len(carried)), encoded[:2]...)
+	return append(append(out, carried...), encoded[2:]...)
+}
+
+// pngCarriedChunks are the ancillary chunks that do not depend on how the
+// pixels are stored.
+var pngCarriedChunks = map[string]bool{
+	"iCCP": true,
+	"sRGB": true,
+	"gAMA": true,
+	"cHRM": true,
+	"pHYs": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+	"eXIf": true,
+}
+
+// carryPNGMetadata inserts the carried chunks of b into the freshly
+// encoded PNG, right after IHDR.
+func carryPNGMetadata(b, encoded []byte) []byte {
+	var carried []byte
+	pngChunks(b, func(kind string, chunk []byte) {
+		if !pngCarriedChunks[kind] {
+			return
+		}
+		if kind == "eXIf" {
+			payload := append([]byte{}, chunk[8:len(chunk)-4]...)
+			resetOrientation(payload)
+			chunk = pngChunk(kind, payload)
+		}
+		carried = append(carried, chunk...)
+	})
+	ihdr := len(pngSignature) + 25
+	out := append(make([]byte, 0, len(encoded)+len(carried)), encoded[:ihdr]...)
+	return append(append(out, carried...), encoded[ihdr:]...)
+}
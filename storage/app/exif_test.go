@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes a width x height JPEG and, for a non zero orientation,
+// inserts an APP1 Exif segment carrying it right after SOI.
+func testJPEG(width, height, orientation int, order binary.ByteOrder) []byte {
+	var buff bytes.Buffer
+	jpeg.Encode(&buff, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	b := buff.Bytes()
+	if orientation == 0 {
+		return b
+	}
+
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, b[:2]...)
+	out = append(out, segment...)
+	return append(out, b[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	cases := []struct {
+		data        []byte
+		orientation int
+	}{
+		{testJPEG(8, 4, 0, binary.BigEndian), 1},
+		{testJPEG(8, 4, 6, binary.BigEndian), 6},
+		{testJPEG(8, 4, 8, binary.LittleEndian), 8},
+		{testJPEG(8, 4, 3, binary.LittleEndian), 3},
+		{testJPEG(8, 4, 9, binary.BigEndian), 1},
+		{testPNG(8, 4), 1},
+		{[]byte{0xff, 0xd8, 0xff, 0xe1, 0xff}, 1},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.orientation, jpegOrientation(tc.data))
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 2x1 image with a red left and a blue right pixel
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	cases := []struct {
+		orientation int
+		size        image.Point
+		first       color.RGBA
+	}{
+		{1, image.Pt(2, 1), red},
+		{2, image.Pt(2, 1), blue},
+		{3, image.Pt(2, 1), blue},
+		{4, image.Pt(2, 1), red},
+		{5, image.Pt(1, 2), red},
+		{6, image.Pt(1, 2), red},
+		{7, image.Pt(1, 2), blue},
+		{8, image.Pt(1, 2), blue},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			img := orient(src, tc.orientation)
+			assert.Equal(t, tc.size, img.Bounds().Size())
+			assert.Equal(t, tc.first, color.RGBAModel.Convert(img.At(0, 0)))
+		})
+	}
+}
+
+func TestVariantsOrientation(t *testing.T) {
+	normalize := true
+	cases := []struct {
+		options   Options
+		normalize *bool
+		original  image.Point
+	}{
+		{Options{}, nil, image.Pt(40, 20)},
+		{Options{NormalizeOrientation: true}, nil, image.Pt(20, 40)},
+		{Options{}, &normalize, image.Pt(20, 40)},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), tc.options)
+			data := testJPEG(40, 20, 6, binary.BigEndian)
+			info, err := s.Save(File{Name: "p.jpg", Type: "image/jpeg", Content: bytes.NewReader(data), Normalize: tc.normalize})
+			assert.Nil(t, err)
+			_, err = s.Variants(File{Name: info.Name, Type: "image/jpeg", Content: bytes.NewReader(data)})
+			assert.Nil(t, err)
+
+			for variant, size := range map[string]image.Point{"": tc.original, "thumb": image.Pt(20, 40)} {
+				obj, _, err := s.Open("p.jpg")
+				if variant != "" {
+					obj, _, err = s.OpenVariant("p.jpg", variant)
+				}
+				assert.Nil(t, err)
+				config, _, err := image.DecodeConfig(obj)
+				obj.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, size, image.Pt(config.Width, config.Height), variant)
+			}
+		})
+	}
+}
+
+func TestNormalizeOrientation(t *testing.T) {
+	icc := jpegSegment(0xe2, append(append([]byte{}, iccHeader...), 1, 1, 'p', 'r', 'o', 'f'))
+	iccp := pngChunk("iCCP", []byte("icc\x00\x00profile"))
+	text := pngChunk("tEXt", []byte("Author\x00me"))
+	exif := exifWithGPS(6)[len(exifHeader):]
+
+	var tiffData bytes.Buffer
+	tiff.Encode(&tiffData, image.NewRGBA(image.Rect(0, 0, 40, 20)), nil)
+
+	cases := []struct {
+		mimeType string
+		data     []byte
+		removed  []string
+		kept     [][]byte
+		size     image.Point
+	}{
+		{"image/jpeg", withSegments(testJPEG(40, 20, 0, binary.BigEndian), jpegSegment(0xe1, exifWithGPS(6)), icc), nil, [][]byte{icc}, image.Pt(20, 40)},
+		{"image/png", withChunks(testPNG(40, 20), iccp, pngChunk("eXIf", exif), text), nil, [][]byte{iccp, text}, image.Pt(20, 40)},
+		{"image/png", testPNG(40, 20), nil, nil, image.Pt(40, 20)},
+		{
+			"image/tiff",
+			withTIFFTags(tiffData.Bytes(), tiffEntry{exifOrientationTag, 3, 1, 6}, tiffEntry{305, 2, 4, binary.LittleEndian.Uint32([]byte("cam\x00"))}),
+			[]string{"text"}, nil, image.Pt(20, 40),
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			out, removed, err := normalizeOrientation(tc.mimeType, tc.data)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.removed, removed)
+			assert.Equal(t, 1, imageOrientation(tc.mimeType, out))
+			for _, kept := range tc.kept {
+				assert.True(t, bytes.Contains(out, kept))
+			}
+			if tc.mimeType != "image/tiff" {
+				// the rest of the EXIF comes along
+				_, gps := tiffTags(exifOf(tc.mimeType, out), exifGPSTag)[exifGPSTag]
+				assert.Equal(t, tc.size.X == 20, gps)
+			}
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(out))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.size, image.Pt(config.Width, config.Height))
+		})
+	}
+}
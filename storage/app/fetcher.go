@@ -0,0 +1,317 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedAddress   = newError(http.StatusBadRequest, "blocked_address", "address is not allowed")
+	ErrBadScheme        = newError(http.StatusBadRequest, "bad_scheme", "only http and https urls are allowed")
+	ErrTooManyRedirects = newError(http.StatusBadGateway, "too_many_redirects", "too many redirects")
+	ErrTooManyURLs      = newError(http.StatusBadRequest, "too_many_urls", "too many urls in one request")
+	ErrImportTimeout    = newError(http.StatusGatewayTimeout, "import_timeout", "the import ran out of time before the url was fetched")
+)
+
+// StatusError is returned for responses other than 2xx.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server responded %s", e.Status)
+}
+
+// blockedNets are never fetched from: loopback, private, link-local (cloud
+// metadata lives at 169.254.169.254), shared, multicast and reserved ranges.
+var blockedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+type FetcherOptions struct {
+	// Timeout bounds the whole fetch, body included
+	Timeout      time.Duration
+	MaxRedirects int
+	MaxBytes     int64
+	// Allow are CIDRs fetched from even when they are blocked, e.g. an
+	// internal image host
+	Allow []string
+	// InsecureSkipVerify turns TLS verification off
+	InsecureSkipVerify bool
+	// Workers bounds the concurrent fetches of FetchAll
+	Workers int
+	// MaxURLs bounds the urls of one FetchAll, the default when not
+	// positive
+	MaxURLs int
+	// ImportTimeout bounds a whole FetchAll, the urls not fetched by then
+	// fail with ErrImportTimeout. The default when not positive
+	ImportTimeout time.Duration
+}
+
+var DefaultFetcherOptions = FetcherOptions{
+	Timeout:       30 * time.Second,
+	MaxRedirects:  5,
+	MaxBytes:      DefaultLimits.MaxBytes,
+	Workers:       4,
+	MaxURLs:       500,
+	ImportTimeout: 10 * time.Minute,
+}
+
+// Fetcher downloads remote files for /upload/link. Addresses are checked
+// when the connection is made, that is after DNS resolution and again for
+// every redirect, so a name resolving to an internal address is caught too.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	allow    []*net.IPNet
+	workers  int
+	maxURLs  int
+	// importTimeout bounds FetchAll
+	importTimeout time.Duration
+}
+
+// Fetched is a downloaded file, URL is the one after redirects.
+type Fetched struct {
+	URL     *url.URL
+	Header  http.Header
+	Content []byte
+}
+
+func NewFetcher(options FetcherOptions) (*Fetcher, error) {
+	allow, err := parseCIDRList(options.Allow)
+	if err != nil {
+		return nil, err
+	}
+	f := &Fetcher{maxBytes: options.MaxBytes, allow: allow, workers: options.Workers, maxURLs: options.MaxURLs}
+	if f.workers <= 0 {
+		f.workers = 1
+	}
+	if f.maxURLs <= 0 {
+		f.maxURLs = DefaultFetcherOptions.MaxURLs
+	}
+	f.importTimeout = options.ImportTimeout
+	if f.importTimeout <= 0 {
+		f.importTimeout = DefaultFetcherOptions.ImportTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: f.control,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: options.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   options.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > options.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return f, nil
+}
+
+func (f *Fetcher) Fetch(rawurl string) (*Fetched, error) {
+	return f.fetch(context.Background(), rawurl)
+}
+
+func (f *Fetcher) fetch(ctx context.Context, rawurl string) (*Fetched, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, badRequest(err.Error())
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	limits := Limits{MaxBytes: f.maxBytes}
+	if resp.ContentLength > 0 {
+		if err := limits.checkSize(resp.ContentLength); err != nil {
+			return nil, err
+		}
+	}
+	content, err := limits.readAll(resp.Body)
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	return &Fetched{URL: resp.Request.URL, Header: resp.Header, Content: content}, nil
+}
+
+// CheckURLs fails with ErrTooManyURLs when n urls are more than one
+// FetchAll may take.
+func (f *Fetcher) CheckURLs(n int) error {
+	if n > f.maxURLs {
+		return ErrTooManyURLs.with(fmt.Sprintf("too many urls, at most %d are allowed", f.maxURLs))
+	}
+	return nil
+}
+
+// FetchAll fetches urls with a bounded number of workers. done is called
+// for each of them, with its index, as the fetches finish. The calls are
+// made one at a time from the calling goroutine, so done may save without
+// locking. Callers check the number of urls with CheckURLs first. Past the
+// import timeout the fetches running are cut and the others are not
+// started, they fail with ErrImportTimeout.
+func (f *Fetcher) FetchAll(urls []string, done func(i int, fetched *Fetched, err error)) {
+	type result struct {
+		i       int
+		fetched *Fetched
+		err     error
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.importTimeout)
+	defer cancel()
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < f.workers && w < len(urls); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					results <- result{i, nil, ErrImportTimeout}
+					continue
+				}
+				fetched, err := f.fetch(ctx, urls[i])
+				if err != nil && ctx.Err() != nil {
+					err = ErrImportTimeout
+				}
+				results <- result{i, fetched, err}
+			}
+		}()
+	}
+	go func() {
+		for i := range urls {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	for r := range results {
+		done(r.i, r.fetched, r.err)
+	}
+}
+
+// control runs right before connecting, with the resolved address.
+func (f *Fetcher) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !f.allowed(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+func (f *Fetcher) allowed(ip net.IP) bool {
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrBadScheme
+	}
+	return nil
+}
+
+// fetchError digs the errors of this file out of the url and net errors
+// wrapping them, the others are ErrFetch.
+func fetchError(err error) error {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			if e.Timeout() {
+				return ErrFetch.wrap(fmt.Errorf("timed out fetching %s", e.URL))
+			}
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return ErrFetch.wrap(err)
+		}
+	}
+}
+
+func parseCIDRList(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRList(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestFetcher allows loopback, where httptest servers listen.
+func newTestFetcher(t *testing.T, options FetcherOptions) *Fetcher {
+	options.Allow = append(options.Allow, "127.0.0.0/8", "::1/128")
+	f, err := NewFetcher(options)
+	assert.Nil(t, err)
+	return f
+}
+
+func TestFetch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG(1, 1))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/image.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, 2048))
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat([]byte{0}, 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	mux.HandleFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	f := newTestFetcher(t, FetcherOptions{
+		Timeout:      100 * time.Millisecond,
+		MaxRedirects: 3,
+		MaxBytes:     1024,
+	})
+	cases := []struct {
+		path string
+		err  error
+		url  string
+	}{
+		{"/image.png", nil, "/image.png"},
+		{"/redirect", nil, "/image.png"},
+		{"/loop", ErrTooManyRedirects, ""},
+		{"/big", ErrTooLarge, ""},
+		{"/chunked", ErrTooLarge, ""},
+		{"/internal", ErrBlockedAddress, ""},
+		{"/file", ErrBadScheme, ""},
+		{"/gone", &StatusError{Code: 404, Status: "404 Not Found"}, ""},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			fetched, err := f.Fetch(server.URL + tc.path)
+			assert.Equal(t, tc.err, err)
+			if tc.err == nil {
+				assert.Equal(t, tc.url, fetched.URL.Path)
+				assert.Equal(t, testPNG(1, 1), fetched.Content)
+			}
+		})
+	}
+
+	_, err := f.Fetch(server.URL + "/slow")
+	assert.NotNil(t, err)
+}
+
+func TestFetchBlocked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	f, err := NewFetcher(DefaultFetcherOptions)
+	assert.Nil(t, err)
+	for _, u := range []string{
+		server.URL,
+		"http://localhost:" + strconv.Itoa(server.Listener.Addr().(*net.TCPAddr).Port),
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+		"http://[::1]/",
+	} {
+		_, err := f.Fetch(u)
+		assert.Equal(t, ErrBlockedAddress, err, u)
+	}
+
+	for _, u := range []string{"ftp://example.com/image.png", "file:///etc/passwd", "gopher://example.com"} {
+		_, err := f.Fetch(u)
+		assert.Equal(t, ErrBadScheme, err, u)
+	}
+}
+
+func TestFetcherAllowed(t *testing.T) {
+	f, err := NewFetcher(FetcherOptions{Allow: []string{"10.1.0.0/16"}})
+	assert.Nil(t, err)
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.2.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.allowed, f.allowed(net.ParseIP(tc.ip)))
+		})
+	}
+
+	_, err = NewFetcher(FetcherOptions{Allow: []string{"10.1.0.0"}})
+	assert.NotNil(t, err)
+}
+
+func TestFetchAll(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			http.Redirect(w, r, "http://10.0.0.1/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(t, FetcherOptions{Timeout: time.Second, MaxRedirects: 1, Workers: 3})
+	var urls []string
+	for i := 0; i < 10; i++ {
+		urls = append(urls, fmt.Sprintf("%s/%d", server.URL, i))
+	}
+	urls = append(urls, server.URL+"/missing")
+
+	seen := make([]bool, len(urls))
+	f.FetchAll(urls, func(i int, fetched *Fetched, err error) {
+		seen[i] = true
+		if i == len(urls)-1 {
+			assert.Equal(t, ErrBlockedAddress, err)
+			return
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("/%d", i), string(fetched.Content))
+	})
+	for i := range seen {
+		assert.True(t, seen[i], i)
+	}
+	assert.True(t, peak > 1 && peak <= 3, peak)
+}
+
+func TestFetchAllTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(t, FetcherOptions{Timeout: time.Second, Workers: 1, ImportTimeout: 100 * time.Millisecond})
+	urls := []string{server.URL + "/fast", server.URL + "/slow", server.URL + "/late"}
+	errs := make([]error, len(urls))
+	start := time.Now()
+	f.FetchAll(urls, func(i int, fetched *Fetched, err error) {
+		errs[i] = err
+	})
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+	assert.Nil(t, errs[0])
+	assert.Equal(t, ErrImportTimeout, errs[1])
+	assert.Equal(t, ErrImportTimeout, errs[2])
+}
@@ -1,16 +1,69 @@
 package app
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type File struct {
-	Name    string
-	Size    int
-	Type    string
-	Content io.Reader
+	Name      string
+	Size      int
+	Type      string
+	Content   io.Reader
+	Naming    Naming
+	Collision Collision
+	// Normalize overrides Options.NormalizeOrientation when set
+	Normalize *bool
+	// Strip overrides Options.StripMetadata when set
+	Strip *bool
+	// Format, Quality and KeepSource override the conversion options
+	// when set, a Format equal to Type turns conversion off
+	Format     string
+	Quality    int
+	KeepSource *bool
 }
 
 type FileDTO struct {
-	Name   string `json:"name"`
-	Path   string `json:"path"`
-	Resize string `json:"resize"`
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Resize   string            `json:"resize"`
+	Variants map[string]string `json:"variants"`
+	Hash     string            `json:"hash"`
+	Stripped []string          `json:"stripped,omitempty"`
+	Source   string            `json:"source,omitempty"`
+}
+
+// UploadResultDTO reports one file of an upload, File is set when it was
+// saved, Error and its Code when it was not.
+type UploadResultDTO struct {
+	Name   string   `json:"name"`
+	Status int      `json:"status"`
+	File   *FileDTO `json:"file,omitempty"`
+	Code   string   `json:"code,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// LinkResultDTO reports one url of a links import, File is set when it was
+// saved, Error and its Code when it was not.
+type LinkResultDTO struct {
+	URL    string   `json:"url"`
+	Status int      `json:"status"`
+	File   *FileDTO `json:"file,omitempty"`
+	Code   string   `json:"code,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type FileInfo struct {
+	Name     string
+	Size     int64
+	Type     string
+	Hash     string
+	Modified time.Time
+	// Stripped lists the kinds of metadata removed on save
+	Stripped []string
+	// Source is the name the kept original of a converted file is served
+	// under
+	Source string
+	// Created is set by Save when the name did not exist before
+	Created bool
 }
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"fmt"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Format is an accepted image type. Decoding goes through image.Decode, so
+// the decoder package has to be imported for the format to be usable.
+type Format struct {
+	// Type is the canonical mime type, Aliases are other names clients
+	// send for it
+	Type    string
+	Aliases []string
+	// Ext is the extension given to generated names
+	Ext string
+	// Magic are prefixes of the content, checked before
+	// http.DetectContentType which does not know every format
+	Magic []string
+	// Encode is nil for formats that can be read only
+	Encode func(w io.Writer, img image.Image, quality int) error
+	// Derived is the type variants and transforms are encoded to, the
+	// format itself when empty
+	Derived string
+	// Opaque formats have no alpha channel, images are flattened onto
+	// white before they are encoded
+	Opaque bool
+}
+
+var formats []Format
+
+// RegisterFormat adds a format or replaces the one with the same type.
+func RegisterFormat(f Format) {
+	for i := range formats {
+		if formats[i].Type == f.Type {
+			formats[i] = f
+			return
+		}
+	}
+	formats = append(formats, f)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Type:    "image/jpeg",
+		Aliases: []string{"image/jpg", "image/pjpeg"},
+		Ext:     ".jpg",
+		Opaque:  true,
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			if quality == 0 {
+				quality = jpeg.DefaultQuality
+			}
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+		},
+	})
+	RegisterFormat(Format{
+		Type: "image/png",
+		Ext:  ".png",
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			return png.Encode(w, img)
+		},
+	})
+	// only the first frame of an animation is decoded, so variants are
+	// stills and png keeps them sharper than a 256 colour palette
+	RegisterFormat(Format{
+		Type: "image/gif",
+		Ext:  ".gif",
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			return gif.Encode(w, img, nil)
+		},
+		Derived: "image/png",
+	})
+	// there is no WebP encoder, WebP is read only
+	RegisterFormat(Format{
+		Type:    "image/webp",
+		Ext:     ".webp",
+		Magic:   []string{"RIFF????WEBPVP"},
+		Derived: "image/png",
+	})
+	RegisterFormat(Format{
+		Type:    "image/bmp",
+		Aliases: []string{"image/x-bmp", "image/x-ms-bmp"},
+		Ext:     ".bmp",
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			return bmp.Encode(w, img)
+		},
+		Derived: "image/png",
+	})
+	RegisterFormat(Format{
+		Type:  "image/tiff",
+		Ext:   ".tiff",
+		Magic: []string{"II*\x00", "MM\x00*"},
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+		},
+		Derived: "image/png",
+	})
+}
+
+// ParseFormat takes a mime type or a bare name like "jpeg" and returns the
+// canonical type, provided images can be encoded to it.
+func ParseFormat(s string) (string, error) {
+	mimeType := strings.ToLower(strings.TrimSpace(s))
+	if !strings.Contains(mimeType, "/") {
+		mimeType = "image/" + mimeType
+	}
+	f, ok := formatFor(mimeType)
+	if !ok || f.Encode == nil {
+		return "", fmt.Errorf("can not convert images to %s", s)
+	}
+	return f.Type, nil
+}
+
+func formatFor(mimeType string) (Format, bool) {
+	mimeType = strings.ToLower(mimeType)
+	for _, f := range formats {
+		if f.Type == mimeType {
+			return f, true
+		}
+		for _, alias := range f.Aliases {
+			if alias == mimeType {
+				return f, true
+			}
+		}
+	}
+	return Format{}, false
+}
+
+// derivedType is the type variants and transforms of mimeType are encoded
+// to by default.
+func derivedType(mimeType string) string {
+	f, ok := formatFor(mimeType)
+	if !ok {
+		return mimeType
+	}
+	if f.Derived != "" {
+		return f.Derived
+	}
+	return f.Type
+}
+
+// detectType sniffs the content type, formats registered with magic
+// prefixes are checked first.
+func detectType(b []byte) string {
+	for _, f := range formats {
+		for _, magic := range f.Magic {
+			if matchMagic(b, magic) {
+				return f.Type
+			}
+		}
+	}
+	return http.DetectContentType(b)
+}
+
+// matchMagic compares a prefix where '?' matches any byte.
+func matchMagic(b []byte, magic string) bool {
+	if len(b) < len(magic) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeImage(w io.Writer, img image.Image, mimeType string, quality int) error {
+	f, ok := formatFor(mimeType)
+	if !ok || f.Encode == nil {
+		return fmt.Errorf("could not encode image to %s", mimeType)
+	}
+	if f.Opaque {
+		img = flatten(img)
+	}
+	return f.Encode(w, img, quality)
+}
+
+// flatten draws images that may be transparent onto a white background.
+func flatten(img image.Image) image.Image {
+	if _, ok := img.(*image.YCbCr); ok {
+		return img
+	}
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.ZP, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// withExt swaps the extension of name for the one of mimeType.
+func withExt(name, mimeType string) string {
+	f, ok := formatFor(mimeType)
+	if !ok {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + f.Ext
+}
+
+func checkMimeType(mimeType string) bool {
+	_, ok := formatFor(mimeType)
+	return ok
+}
+
+func canonicalMimeType(mimeType string) string {
+	if f, ok := formatFor(mimeType); ok {
+		return f.Type
+	}
+	return mimeType
+}
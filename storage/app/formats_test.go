@@ -0,0 +1,204 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/gif"
+	"testing"
+)
+
+// a 1x1 lossless WebP, there is no encoder to make one
+var testWebP, _ = base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+
+func testImage(mimeType string, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	var buff bytes.Buffer
+	switch mimeType {
+	case "image/gif":
+		gif.Encode(&buff, img, nil)
+	case "image/bmp":
+		bmp.Encode(&buff, img)
+	case "image/tiff":
+		tiff.Encode(&buff, img, nil)
+	case "image/jpeg":
+		return testJPEG(width, height, 0, binary.BigEndian)
+	default:
+		return testPNG(width, height)
+	}
+	return buff.Bytes()
+}
+
+func TestDetectType(t *testing.T) {
+	cases := []struct {
+		data     []byte
+		mimeType string
+	}{
+		{testImage("image/jpeg", 4, 4), "image/jpeg"},
+		{testImage("image/png", 4, 4), "image/png"},
+		{testImage("image/gif", 4, 4), "image/gif"},
+		{testImage("image/bmp", 4, 4), "image/bmp"},
+		{testImage("image/tiff", 4, 4), "image/tiff"},
+		{testWebP, "image/webp"},
+		{[]byte("MM"), "text/plain; charset=utf-8"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.mimeType, detectType(tc.data))
+		})
+	}
+}
+
+func TestFormatFor(t *testing.T) {
+	cases := []struct {
+		mimeType  string
+		canonical string
+		derived   string
+		ok        bool
+	}{
+		{"image/jpg", "image/jpeg", "image/jpeg", true},
+		{"IMAGE/PNG", "image/png", "image/png", true},
+		{"image/gif", "image/gif", "image/png", true},
+		{"image/x-ms-bmp", "image/bmp", "image/png", true},
+		{"image/webp", "image/webp", "image/png", true},
+		{"image/tiff", "image/tiff", "image/png", true},
+		{"image/svg+xml", "image/svg+xml", "image/svg+xml", false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.ok, checkMimeType(tc.mimeType))
+			assert.Equal(t, tc.canonical, canonicalMimeType(tc.mimeType))
+			assert.Equal(t, tc.derived, derivedType(tc.mimeType))
+		})
+	}
+}
+
+func TestVariantsFormats(t *testing.T) {
+	cases := []struct {
+		mimeType string
+		data     []byte
+		name     string
+		thumb    string
+	}{
+		{"image/gif", testImage("image/gif", 40, 20), "a.gif", "image/png"},
+		{"image/bmp", testImage("image/bmp", 40, 20), "a.bmp", "image/png"},
+		{"image/tiff", testImage("image/tiff", 40, 20), "a.tiff", "image/png"},
+		{"image/webp", testWebP, "a.webp", "image/png"},
+		{"image/jpeg", testImage("image/jpeg", 40, 20), "a.jpg", "image/jpeg"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+			info, err := s.Save(File{Name: "a", Type: detectType(tc.data), Content: bytes.NewReader(tc.data)})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.name, info.Name)
+			assert.Equal(t, tc.mimeType, info.Type)
+
+			paths, err := s.Variants(File{Name: info.Name, Type: info.Type, Content: bytes.NewReader(tc.data)})
+			assert.Nil(t, err)
+			assert.Equal(t, "/images/"+tc.name+"/thumb", paths["thumb"])
+
+			thumb, err := s.StatVariant(tc.name, "thumb")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.thumb, thumb.Type)
+			obj, served, err := s.OpenVariant(tc.name, "thumb")
+			assert.Nil(t, err)
+			obj.Close()
+			assert.Equal(t, tc.thumb, served.Type)
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	cases := []struct {
+		format   string
+		mimeType string
+		err      bool
+	}{
+		{"jpeg", "image/jpeg", false},
+		{"JPG", "image/jpeg", false},
+		{"image/png", "image/png", false},
+		{"gif", "image/gif", false},
+		{"webp", "", true},
+		{"svg+xml", "", true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			mimeType, err := ParseFormat(tc.format)
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.mimeType, mimeType)
+		})
+	}
+}
+
+func TestSaveConvert(t *testing.T) {
+	// a transparent png has to come out white, not black, as a jpeg
+	transparent := testPNG(40, 20)
+	keep := true
+
+	cases := []struct {
+		options Options
+		file    File
+		name    string
+		source  string
+		thumb   string
+	}{
+		{Options{}, File{}, "shot.png", "", "image/png"},
+		{Options{Format: "image/jpeg", Quality: 70}, File{}, "shot.jpg", "", "image/jpeg"},
+		{Options{Format: "image/jpeg"}, File{KeepSource: &keep}, "shot.jpg", "shot.jpg/source.png", "image/jpeg"},
+		{Options{Format: "image/jpeg", KeepSource: true}, File{Format: "image/png"}, "shot.png", "", "image/png"},
+		{Options{}, File{Format: "image/gif"}, "shot.gif", "", "image/png"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), tc.options)
+			file := tc.file
+			file.Name = "shot.png"
+			file.Type = "image/png"
+			file.Content = bytes.NewReader(transparent)
+			info, err := s.Save(file)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.name, info.Name)
+			assert.Equal(t, tc.source, info.Source)
+
+			_, err = s.Variants(File{Name: info.Name, Type: info.Type, Content: bytes.NewReader(transparent)})
+			assert.Nil(t, err)
+			thumb, err := s.StatVariant(info.Name, "thumb")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.thumb, thumb.Type)
+
+			obj, _, err := s.Open(info.Name)
+			assert.Nil(t, err)
+			img, _, err := image.Decode(obj)
+			obj.Close()
+			assert.Nil(t, err)
+			if info.Type == "image/jpeg" {
+				r, g, b, _ := img.At(0, 0).RGBA()
+				assert.True(t, r > 0xf000 && g > 0xf000 && b > 0xf000)
+			}
+
+			if tc.source != "" {
+				source, err := s.StatVariant(info.Name, sourceVariant)
+				assert.Nil(t, err)
+				assert.Equal(t, "image/png", source.Type)
+				list, err := s.List(ListQuery{})
+				assert.Nil(t, err)
+				assert.Len(t, list.Items, 1)
+				deleted, err := s.Delete(info.Name)
+				assert.Nil(t, err)
+				assert.Contains(t, deleted, s.path(tc.source))
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// Limits bound what is accepted for decoding. The dimensions come from
+// image.DecodeConfig, so an image declaring a huge size is turned away
+// before any pixel memory is allocated. Zero values are unlimited.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+	MaxBytes  int64
+}
+
+var DefaultLimits = Limits{
+	MaxWidth:  16384,
+	MaxHeight: 16384,
+	MaxPixels: 50000000,
+	MaxBytes:  32 << 20,
+}
+
+// LimitError is returned for images whose declared dimensions are over the
+// limits.
+type LimitError struct {
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// readAll reads content up to the byte limit.
+func (l Limits) readAll(r io.Reader) ([]byte, error) {
+	if l.MaxBytes <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, l.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > l.MaxBytes {
+		return nil, ErrTooLarge
+	}
+	return b, nil
+}
+
+// reader fails with ErrTooLarge once more than the byte limit was read
+// from r.
+func (l Limits) reader(r io.Reader) io.Reader {
+	if l.MaxBytes <= 0 {
+		return r
+	}
+	return &limitReader{r: r, left: l.MaxBytes}
+}
+
+type limitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, ErrTooLarge
+	}
+	// one byte past the limit tells a file of exactly the limit from a
+	// larger one
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// checkSize rejects content known to be over the byte limit before it is
+// read.
+func (l Limits) checkSize(size int64) error {
+	if l.MaxBytes > 0 && size > l.MaxBytes {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func (l Limits) check(b []byte) error {
+	if err := l.checkSize(int64(len(b))); err != nil {
+		return err
+	}
+	return l.checkConfig(bytes.NewReader(decodableWebP(b)))
+}
+
+// checkConfig checks the declared dimensions, reading no further than the
+// image header.
+func (l Limits) checkConfig(r io.Reader) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		// nothing to bound, decoding fails on its own
+		return nil
+	}
+	switch {
+	case l.MaxWidth > 0 && config.Width > l.MaxWidth:
+		return &LimitError{fmt.Sprintf("image is %d pixels wide, the limit is %d", config.Width, l.MaxWidth)}
+	case l.MaxHeight > 0 && config.Height > l.MaxHeight:
+		return &LimitError{fmt.Sprintf("image is %d pixels high, the limit is %d", config.Height, l.MaxHeight)}
+	case l.MaxPixels > 0 && int64(config.Width)*int64(config.Height) > l.MaxPixels:
+		return &LimitError{fmt.Sprintf("image has %d pixels, the limit is %d", int64(config.Width)*int64(config.Height), l.MaxPixels)}
+	}
+	return nil
+}
+
+// decode reads and checks an image before decoding it the right way up.
+func (l Limits) decode(r io.Reader) (image.Image, error) {
+	b, err := l.readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.check(b); err != nil {
+		return nil, err
+	}
+	return decodeImage(bytes.NewReader(b))
+}
+
+// ParseBytes reads a positive size that may end in K, M or G.
+func ParseBytes(s string) (int64, error) {
+	multiplier := int64(1)
+	number := s
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			multiplier, number = 1<<10, s[:n-1]
+		case 'M', 'm':
+			multiplier, number = 1<<20, s[:n-1]
+		case 'G', 'g':
+			multiplier, number = 1<<30, s[:n-1]
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return value * multiplier, nil
+}
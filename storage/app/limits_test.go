@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// testBomb is a PNG header declaring width x height pixels with no image
+// data behind it.
+func testBomb(width, height int) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = 6
+	b := append([]byte{}, pngSignature...)
+	b = append(b, pngChunk("IHDR", ihdr)...)
+	return append(b, pngChunk("IEND", nil)...)
+}
+
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{MaxWidth: 100, MaxHeight: 50, MaxPixels: 3000, MaxBytes: 1 << 10}
+	cases := []struct {
+		data  []byte
+		err   error
+		limit bool
+	}{
+		{testPNG(100, 30), nil, false},
+		{testBomb(101, 10), nil, true},
+		{testBomb(10, 51), nil, true},
+		{testBomb(100, 31), nil, true},
+		{testBomb(50000, 50000), nil, true},
+		{[]byte("not an image"), nil, false},
+		{bytes.Repeat([]byte{0}, 1<<10+1), ErrTooLarge, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			err := limits.check(tc.data)
+			_, limit := err.(*LimitError)
+			assert.Equal(t, tc.limit, limit)
+			if !tc.limit {
+				assert.Equal(t, tc.err, err)
+			}
+		})
+	}
+}
+
+func TestLimitsReadAll(t *testing.T) {
+	limits := Limits{MaxBytes: 4}
+	b, err := limits.readAll(strings.NewReader("1234"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", string(b))
+	_, err = limits.readAll(strings.NewReader("12345"))
+	assert.Equal(t, ErrTooLarge, err)
+	b, err = Limits{}.readAll(strings.NewReader("12345"))
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(b))
+}
+
+func TestLimitsReader(t *testing.T) {
+	limits := Limits{MaxBytes: 4}
+	b, err := ioutil.ReadAll(limits.reader(strings.NewReader("1234")))
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", string(b))
+	_, err = ioutil.ReadAll(limits.reader(strings.NewReader("12345")))
+	assert.Equal(t, ErrTooLarge, err)
+	_, err = ioutil.ReadAll(limits.reader(iotest.OneByteReader(strings.NewReader("12345"))))
+	assert.Equal(t, ErrTooLarge, err)
+	b, err = ioutil.ReadAll(Limits{}.reader(strings.NewReader("12345")))
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(b))
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := []struct {
+		spec string
+		size int64
+		err  bool
+	}{
+		{"1024", 1024, false},
+		{"32M", 32 << 20, false},
+		{"512k", 512 << 10, false},
+		{"1G", 1 << 30, false},
+		{"0", 0, true},
+		{"M", 0, true},
+		{"-1K", 0, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			size, err := ParseBytes(tc.spec)
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.size, size)
+		})
+	}
+}
+
+func TestSaveLimits(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 64, MaxHeight: 64, MaxBytes: 1 << 10},
+	})
+
+	_, err := s.Save(File{Name: "bomb.png", Type: "image/png", Content: bytes.NewReader(testBomb(50000, 50000))})
+	_, ok := err.(*LimitError)
+	assert.True(t, ok)
+	_, err = s.Stat("bomb.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.Save(File{Name: "big.png", Type: "image/png", Content: bytes.NewReader(bytes.Repeat([]byte{0}, 1<<10+1))})
+	assert.Equal(t, ErrTooLarge, err)
+
+	_, err = s.Variants(File{Name: "bomb.png", Type: "image/png", Content: bytes.NewReader(testBomb(65, 10))})
+	_, ok = err.(*LimitError)
+	assert.True(t, ok)
+
+	_, err = s.Save(File{Name: "ok.png", Type: "image/png", Content: bytes.NewReader(testPNG(64, 64))})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,219 @@
+package app
+
+import (
+	"encoding/base64"
+	json2 "encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+var ErrBadListQuery = newError(http.StatusBadRequest, "bad_list_query", "bad limit, cursor or sort value")
+
+type ListQuery struct {
+	Limit  int
+	Cursor string
+	Type   string
+	Sort   string
+}
+
+type ListItemDTO struct {
+	FileDTO
+	Size     int64     `json:"size"`
+	Type     string    `json:"type"`
+	Modified time.Time `json:"modified"`
+}
+
+type ListDTO struct {
+	Items []ListItemDTO `json:"items"`
+	Next  string        `json:"next,omitempty"`
+}
+
+type listCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	Name string `json:"n"`
+}
+
+type listOrder struct {
+	key  func(ListItemDTO) string
+	desc bool
+	// ref means the key needs the stored metadata of every candidate
+	ref bool
+}
+
+var listOrders = map[string]listOrder{
+	"name":      {key: nameKey},
+	"-name":     {key: nameKey, desc: true},
+	"modified":  {key: modifiedKey},
+	"-modified": {key: modifiedKey, desc: true},
+	"size":      {key: sizeKey, ref: true},
+	"-size":     {key: sizeKey, desc: true, ref: true},
+}
+
+// List streams the backend listing and keeps only the requested page in
+// memory, so large directories are never loaded whole.
+func (s service) List(q ListQuery) (ListDTO, error) {
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	order, ok := listOrders[q.Sort]
+	if !ok {
+		return ListDTO{}, ErrBadListQuery
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultListLimit
+	}
+	if q.Limit < 0 || q.Limit > maxListLimit {
+		return ListDTO{}, ErrBadListQuery
+	}
+	var after *listCursor
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor)
+		if err != nil || cursor.Sort != q.Sort {
+			return ListDTO{}, ErrBadListQuery
+		}
+		after = &cursor
+	}
+
+	less := func(a, b listCursor) bool {
+		if a.Key != b.Key {
+			return (a.Key < b.Key) != order.desc
+		}
+		if a.Name != b.Name {
+			return (a.Name < b.Name) != order.desc
+		}
+		return false
+	}
+
+	page := make([]ListItemDTO, 0, q.Limit+1)
+	keys := make([]listCursor, 0, q.Limit+1)
+	err := s.backend.List(refsPrefix, func(info ObjectInfo) error {
+		name := strings.TrimPrefix(info.Key, refsPrefix)
+		if !checkName(name) {
+			return nil
+		}
+		item := ListItemDTO{
+			FileDTO: FileDTO{
+				Name:     name,
+				Path:     s.path(name),
+				Resize:   s.ThumbnailPath(name),
+				Variants: s.VariantPaths(name),
+			},
+			Modified: info.Modified.UTC(),
+		}
+		if order.ref || q.Type != "" {
+			if err := s.fillListItem(&item); err != nil {
+				return err
+			}
+		}
+		if !matchType(item.Type, q.Type) {
+			return nil
+		}
+		key := listCursor{Sort: q.Sort, Key: order.key(item), Name: name}
+		if after != nil && !less(*after, key) {
+			return nil
+		}
+		i := sort.Search(len(keys), func(i int) bool { return less(key, keys[i]) })
+		if i > q.Limit {
+			return nil
+		}
+		keys = append(keys, listCursor{})
+		copy(keys[i+1:], keys[i:])
+		keys[i] = key
+		page = append(page, ListItemDTO{})
+		copy(page[i+1:], page[i:])
+		page[i] = item
+		if len(page) > q.Limit+1 {
+			keys = keys[:q.Limit+1]
+			page = page[:q.Limit+1]
+		}
+		return nil
+	})
+	if err != nil {
+		return ListDTO{}, err
+	}
+
+	// metadata of the remaining page items is read only now
+	for i := range page {
+		if page[i].Hash != "" {
+			continue
+		}
+		if err := s.fillListItem(&page[i]); err != nil {
+			return ListDTO{}, err
+		}
+	}
+
+	list := ListDTO{Items: page}
+	if len(page) > q.Limit {
+		list.Items = page[:q.Limit]
+		list.Next = encodeCursor(keys[q.Limit-1])
+	}
+	return list, nil
+}
+
+func (s service) fillListItem(item *ListItemDTO) error {
+	r, err := s.readRef(fileRef(item.Name))
+	if err != nil {
+		return err
+	}
+	item.Hash = r.Hash
+	item.Size = r.Size
+	item.Type = r.Type
+	return nil
+}
+
+func matchType(mimeType, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	if !strings.Contains(filter, "/") {
+		exts, _ := mime.ExtensionsByType(mimeType)
+		if f, ok := formatFor(mimeType); ok {
+			exts = append(exts, f.Ext)
+		}
+		for _, ext := range exts {
+			if strings.TrimPrefix(ext, ".") == strings.ToLower(filter) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(mimeType, filter)
+}
+
+func nameKey(i ListItemDTO) string {
+	// names are compared as the tie breaker anyway
+	return ""
+}
+
+func modifiedKey(i ListItemDTO) string {
+	return i.Modified.Format("20060102150405.000000000")
+}
+
+func sizeKey(i ListItemDTO) string {
+	return fmt.Sprintf("%020d", i.Size)
+}
+
+func encodeCursor(c listCursor) string {
+	b, _ := json2.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var c listCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json2.Unmarshal(b, &c)
+	return c, err
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := NewService(NewFsBackend(fs, "/images"), Options{})
+	files := []struct {
+		name    string
+		size    int
+		modTime int64
+	}{
+		{"b.png", 3, 300},
+		{"a.jpg", 1, 200},
+		{"c.png", 2, 100},
+		{"thumb_orphan.png", 5, 400},
+	}
+	for _, f := range files {
+		mimeType := "image/png"
+		if strings.HasSuffix(f.name, ".jpg") {
+			mimeType = "image/jpeg"
+		}
+		_, err := s.Save(File{Name: f.name, Type: mimeType, Content: strings.NewReader(strings.Repeat("1", f.size))})
+		assert.Nil(t, err)
+		fs.Chtimes("/images/"+refKey(f.name), time.Unix(f.modTime, 0), time.Unix(f.modTime, 0))
+	}
+	// variants are not listed, uploads named like them are
+	assert.Nil(t, s.saveDerivative("a.jpg", "thumb", "image/jpeg", []byte("1")))
+
+	cases := []struct {
+		query ListQuery
+		pages [][]string
+	}{
+		{
+			query: ListQuery{Limit: 2},
+			pages: [][]string{{"a.jpg", "b.png"}, {"c.png", "thumb_orphan.png"}},
+		},
+		{
+			query: ListQuery{Limit: 3, Sort: "-size"},
+			pages: [][]string{{"thumb_orphan.png", "b.png", "c.png"}, {"a.jpg"}},
+		},
+		{
+			query: ListQuery{Limit: 1, Sort: "modified", Type: "png"},
+			pages: [][]string{{"c.png"}, {"b.png"}, {"thumb_orphan.png"}},
+		},
+		{
+			query: ListQuery{Type: "image/jpeg"},
+			pages: [][]string{{"a.jpg"}},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			q := tc.query
+			for _, expected := range tc.pages {
+				page, err := s.List(q)
+				assert.Nil(t, err)
+				var names []string
+				for _, item := range page.Items {
+					names = append(names, item.Name)
+				}
+				assert.Equal(t, expected, names)
+				q.Cursor = page.Next
+			}
+			assert.Empty(t, q.Cursor)
+		})
+	}
+}
+
+func TestListBadQuery(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+	cases := []ListQuery{
+		{Sort: "blah"},
+		{Limit: maxListLimit + 1},
+		{Cursor: "!!!"},
+		{Cursor: encodeCursor(listCursor{Sort: "size"}), Sort: "name"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			_, err := s.List(tc)
+			assert.Equal(t, ErrBadListQuery, err)
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/tiff"
+	"hash/crc32"
+	"sort"
+)
+
+var (
+	xmpHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtHeader    = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	iccHeader       = []byte("ICC_PROFILE\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+	pngSignature    = []byte("\x89PNG\r\n\x1a\n")
+)
+
+var errBadImage = errors.New("could not parse image structure")
+
+// stripMetadata drops EXIF, XMP, IPTC and text metadata from an encoded
+// image. Only TIFF is decoded, it is encoded again. The ICC profile and the
+// orientation are kept, the orientation in an EXIF or TIFF tag of its own.
+// It returns the new content and the kinds of metadata it removed.
+func stripMetadata(mimeType string, b []byte) ([]byte, []string, error) {
+	switch canonicalMimeType(mimeType) {
+	case "image/jpeg":
+		return stripJPEG(b)
+	case "image/png":
+		return stripPNG(b)
+	case "image/webp":
+		return stripWebP(b)
+	case "image/gif":
+		return stripGIF(b)
+	case "image/tiff":
+		return stripTIFF(b)
+	case "image/bmp":
+		// BMP has no room for metadata but the color profile
+		return b, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("metadata of %s is not supported", mimeType)
+	}
+}
+
+func stripJPEG(b []byte) ([]byte, []string, error) {
+	removed := map[string]bool{}
+	orientation := 1
+	out := append(make([]byte, 0, len(b)), b[:2]...)
+	var kept [][]byte
+	sos := jpegSegments(b, func(marker byte, segment []byte) bool {
+		payload := segment[4:]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, exifHeader):
+			tags := exifTags(payload, exifOrientationTag, exifGPSTag)
+			if o, ok := tags[exifOrientationTag]; ok && o >= 1 && o <= 8 {
+				orientation = int(o)
+			}
+			if _, ok := tags[exifGPSTag]; ok {
+				removed["gps"] = true
+			}
+			removed["exif"] = true
+		case marker == 0xe1 && (bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtHeader)):
+			removed["xmp"] = true
+		case marker == 0xed && bytes.HasPrefix(payload, photoshopHeader):
+			removed["iptc"] = true
+		case marker == 0xfe:
+			removed["comment"] = true
+		case marker == 0xe2 && bytes.HasPrefix(payload, iccHeader):
+			kept = append(kept, segment)
+		case marker >= 0xe1 && marker <= 0xef && marker != 0xee:
+			// other application data, Adobe (APP14) is needed for colors
+			removed["application"] = true
+		default:
+			kept = append(kept, segment)
+		}
+		return true
+	})
+	if sos < 0 {
+		return nil, nil, errBadImage
+	}
+	if len(removed) == 0 {
+		return b, nil, nil
+	}
+
+	// JFIF has to stay the first segment, the orientation goes after it
+	i := 0
+	for ; i < len(kept) && kept[i][1] == 0xe0; i++ {
+		out = append(out, kept[i]...)
+	}
+	if orientation != 1 {
+		out = append(out, orientationSegment(orientation)...)
+	}
+	for _, segment := range kept[i:] {
+		out = append(out, segment...)
+	}
+	out = append(out, b[sos:]...)
+	return out, sortedKeys(removed), nil
+}
+
+var pngMetadataChunks = map[string]string{
+	"tEXt": "text",
+	"zTXt": "text",
+	"iTXt": "text",
+	"eXIf": "exif",
+	"tIME": "time",
+}
+
+func stripPNG(b []byte) ([]byte, []string, error) {
+	removed := map[string]bool{}
+	out := append(make([]byte, 0, len(b)), pngSignature...)
+	ok := pngChunks(b, func(kind string, chunk []byte) {
+		name, ok := pngMetadataChunks[kind]
+		if !ok {
+			out = append(out, chunk...)
+			return
+		}
+		removed[name] = true
+		if kind != "eXIf" {
+			return
+		}
+		tags := tiffTags(chunk[8:len(chunk)-4], exifOrientationTag, exifGPSTag)
+		if _, ok := tags[exifGPSTag]; ok {
+			removed["gps"] = true
+		}
+		if o := tags[exifOrientationTag]; o >= 2 && o <= 8 {
+			out = append(out, pngChunk("eXIf", orientationTIFF(int(o)))...)
+		}
+	})
+	if !ok {
+		return nil, nil, errBadImage
+	}
+	if len(removed) == 0 {
+		return b, nil, nil
+	}
+	return out, sortedKeys(removed), nil
+}
+
+// pngChunks calls fn for every chunk of a PNG with its type and the whole
+// chunk, length and CRC included. It returns false when b is no PNG or is
+// cut off.
+func pngChunks(b []byte, fn func(kind string, chunk []byte)) bool {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return false
+	}
+	for i := len(pngSignature); i < len(b); {
+		if i+12 > len(b) {
+			return false
+		}
+		length := int(binary.BigEndian.Uint32(b[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(b) {
+			return false
+		}
+		fn(string(b[i+4:i+8]), b[i:end])
+		i = end
+	}
+	return true
+}
+
+// pngChunk builds a PNG chunk with its CRC.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+// VP8X feature flags
+const (
+	webpFlagXMP   = 0x04
+	webpFlagEXIF  = 0x08
+	webpFlagAlpha = 0x10
+)
+
+func stripWebP(b []byte) ([]byte, []string, error) {
+	if len(b) < 12 {
+		return nil, nil, errBadImage
+	}
+	removed := map[string]bool{}
+	exif := false
+	out := append(make([]byte, 0, len(b)), b[:12]...)
+	ok := webpChunks(b, func(kind string, chunk, payload []byte) {
+		switch kind {
+		case "EXIF":
+			tags := tiffTags(bytes.TrimPrefix(payload, exifHeader), exifOrientationTag, exifGPSTag)
+			if _, ok := tags[exifGPSTag]; ok {
+				removed["gps"] = true
+			}
+			if o := tags[exifOrientationTag]; o >= 2 && o <= 8 {
+				out = append(out, webpChunk("EXIF", orientationTIFF(int(o)))...)
+				exif = true
+			}
+			removed["exif"] = true
+		case "XMP ":
+			removed["xmp"] = true
+		default:
+			out = append(out, chunk...)
+		}
+	})
+	if !ok {
+		return nil, nil, errBadImage
+	}
+	if len(removed) == 0 {
+		return b, nil, nil
+	}
+	if len(out) >= 30 && string(out[12:16]) == "VP8X" {
+		out[20] &^= webpFlagXMP
+		if !exif {
+			out[20] &^= webpFlagEXIF
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, sortedKeys(removed), nil
+}
+
+// webpChunks calls fn for every chunk of a WebP with its type, the whole
+// chunk, padding included, and its payload. It returns false when b is no
+// WebP or is cut off.
+func webpChunks(b []byte, fn func(kind string, chunk, payload []byte)) bool {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return false
+	}
+	for i := 12; i < len(b); {
+		if i+8 > len(b) {
+			return false
+		}
+		size := int(binary.LittleEndian.Uint32(b[i+4 : i+8]))
+		end := i + 8 + size + size&1
+		if size < 0 || i+8+size > len(b) {
+			return false
+		}
+		if end > len(b) {
+			// a missing pad byte after the last chunk is common
+			end = len(b)
+		}
+		fn(string(b[i:i+4]), b[i:end], b[i+8:i+8+size])
+		i = end
+	}
+	return true
+}
+
+// webpChunk builds a RIFF chunk, padded to an even length.
+func webpChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 8, 9+len(data))
+	copy(chunk, kind)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// gifKeptApplications are the application extensions players need, loops
+// and the ICC profile.
+var gifKeptApplications = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+	"ICCRGBG1012": true,
+}
+
+func stripGIF(b []byte) ([]byte, []string, error) {
+	if len(b) < 13 || (string(b[:6]) != "GIF87a" && string(b[:6]) != "GIF89a") {
+		return nil, nil, errBadImage
+	}
+	i := 13 + gifColorTable(b[10])
+	if i > len(b) {
+		return nil, nil, errBadImage
+	}
+	removed := map[string]bool{}
+	out := append(make([]byte, 0, len(b)), b[:i]...)
+	for i < len(b) && b[i] != 0x3b {
+		var end int
+		kind := ""
+		switch {
+		case b[i] == 0x21 && i+2 <= len(b):
+			end = gifSubBlocks(b, i+2)
+			switch {
+			case b[i+1] == 0xfe:
+				kind = "comment"
+			case b[i+1] != 0xff:
+			case i+14 <= len(b) && b[i+2] == 11 && string(b[i+3:i+14]) == "XMP DataXMP":
+				kind = "xmp"
+			case i+14 > len(b) || b[i+2] != 11 || !gifKeptApplications[string(b[i+3:i+14])]:
+				kind = "application"
+			}
+		case b[i] == 0x2c && i+10 <= len(b):
+			// the descriptor, a local color table and the LZW code size
+			end = gifSubBlocks(b, i+11+gifColorTable(b[i+9]))
+		default:
+			return nil, nil, errBadImage
+		}
+		if end < 0 {
+			return nil, nil, errBadImage
+		}
+		if kind != "" {
+			removed[kind] = true
+		} else {
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+	if len(removed) == 0 {
+		return b, nil, nil
+	}
+	return append(out, 0x3b), sortedKeys(removed), nil
+}
+
+// gifColorTable is the size of the color table announced by the flags of a
+// screen or image descriptor.
+func gifColorTable(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << (flags&7 + 1)
+}
+
+// gifSubBlocks returns the end of the data sub-blocks starting at i, or -1
+// when they are cut off.
+func gifSubBlocks(b []byte, i int) int {
+	for i < len(b) {
+		n := int(b[i])
+		i += 1 + n
+		if n == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// tiffMetadataTags are the tags of IFD0 stripped from TIFFs by kind.
+var tiffMetadataTags = map[uint16]string{
+	270:        "text", // ImageDescription
+	271:        "text", // Make
+	272:        "text", // Model
+	305:        "text", // Software
+	306:        "time", // DateTime
+	315:        "text", // Artist
+	700:        "xmp",
+	33432:      "text", // Copyright
+	33723:      "iptc",
+	34377:      "iptc", // Photoshop
+	34665:      "exif",
+	exifGPSTag: "gps",
+}
+
+// tiffICCTag holds the ICC profile of a TIFF.
+const tiffICCTag = 34675
+
+// stripTIFF re-encodes a TIFF holding metadata, its tags can not be dropped
+// in place without leaving the data they point at behind. The orientation
+// and the ICC profile are written back as tags, pages past the first are
+// lost with the metadata.
+func stripTIFF(b []byte) ([]byte, []string, error) {
+	if len(b) < 8 || (string(b[:4]) != "II*\x00" && string(b[:4]) != "MM\x00*") {
+		return nil, nil, errBadImage
+	}
+	removed, orientation := tiffMetadata(b)
+	if len(removed) == 0 {
+		return b, nil, nil
+	}
+	out, err := encodeTIFF(b, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if orientation != 1 {
+		value := make([]byte, 2)
+		tiffByteOrder(out).PutUint16(value, uint16(orientation))
+		out = withTIFFFields(out, tiffField{tag: exifOrientationTag, kind: 3, count: 1, value: value})
+	}
+	return out, sortedKeys(removed), nil
+}
+
+// encodeTIFF encodes the first page of a TIFF again with orientation
+// applied, keeping its ICC profile but no other tag.
+func encodeTIFF(b []byte, orientation int) ([]byte, error) {
+	img, err := tiff.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buff bytes.Buffer
+	if err := encodeImage(&buff, orient(img, orientation), "image/tiff", 0); err != nil {
+		return nil, err
+	}
+	out := buff.Bytes()
+	if icc, ok := tiffFieldOf(b, tiffICCTag); ok {
+		out = withTIFFFields(out, icc)
+	}
+	return out, nil
+}
+
+// tiffMetadata returns the kinds of metadata in IFD0 of a TIFF and its
+// orientation.
+func tiffMetadata(b []byte) (map[string]bool, int) {
+	wanted := []uint16{exifOrientationTag}
+	for tag := range tiffMetadataTags {
+		wanted = append(wanted, tag)
+	}
+	removed := map[string]bool{}
+	orientation := 1
+	for tag, value := range tiffTags(b, wanted...) {
+		if tag != exifOrientationTag {
+			removed[tiffMetadataTags[tag]] = true
+		} else if value >= 1 && value <= 8 {
+			orientation = int(value)
+		}
+	}
+	return removed, orientation
+}
+
+// mergeKinds joins two sorted lists of metadata kinds, it is nil when both
+// are empty.
+func mergeKinds(a, b []string) []string {
+	kinds := map[string]bool{}
+	for _, kind := range append(append([]string{}, a...), b...) {
+		kinds[kind] = true
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	return sortedKeys(kinds)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
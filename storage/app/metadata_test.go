@@ -0,0 +1,391 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// withSegments inserts segments into a JPEG right after SOI.
+func withSegments(b []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, b[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, b[2:]...)
+}
+
+// exifWithGPS is an Exif payload with an orientation and a GPS IFD pointer.
+func exifWithGPS(orientation int) []byte {
+	tiff := make([]byte, 38)
+	copy(tiff, "II")
+	binary.LittleEndian.PutUint16(tiff[2:], 42)
+	binary.LittleEndian.PutUint32(tiff[4:], 8)
+	binary.LittleEndian.PutUint16(tiff[8:], 2)
+	binary.LittleEndian.PutUint16(tiff[10:], exifOrientationTag)
+	binary.LittleEndian.PutUint16(tiff[12:], 3)
+	binary.LittleEndian.PutUint32(tiff[14:], 1)
+	binary.LittleEndian.PutUint16(tiff[18:], uint16(orientation))
+	binary.LittleEndian.PutUint16(tiff[22:], exifGPSTag)
+	binary.LittleEndian.PutUint16(tiff[24:], 4)
+	binary.LittleEndian.PutUint32(tiff[26:], 1)
+	binary.LittleEndian.PutUint32(tiff[30:], 38)
+	return append(append([]byte{}, exifHeader...), tiff...)
+}
+
+// withChunks inserts chunks into a PNG right after IHDR.
+func withChunks(b []byte, chunks ...[]byte) []byte {
+	ihdr := len(pngSignature) + 25
+	out := append([]byte{}, b[:ihdr]...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return append(out, b[ihdr:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	icc := jpegSegment(0xe2, append(append([]byte{}, iccHeader...), 1, 1, 'p', 'r', 'o', 'f'))
+	iccp := pngChunk("iCCP", []byte("icc\x00\x00profile"))
+
+	cases := []struct {
+		mimeType    string
+		data        []byte
+		removed     []string
+		kept        [][]byte
+		orientation int
+	}{
+		{
+			"image/jpeg",
+			testJPEG(8, 4, 0, binary.BigEndian),
+			nil, nil, 1,
+		},
+		{
+			"image/jpeg",
+			withSegments(testJPEG(8, 4, 0, binary.BigEndian),
+				jpegSegment(0xe1, exifWithGPS(6)),
+				jpegSegment(0xe1, append(append([]byte{}, xmpHeader...), "<x:xmpmeta/>"...)),
+				icc,
+				jpegSegment(0xed, append(append([]byte{}, photoshopHeader...), "8BIM"...)),
+				jpegSegment(0xfe, []byte("taken at home")),
+			),
+			[]string{"comment", "exif", "gps", "iptc", "xmp"},
+			[][]byte{icc},
+			6,
+		},
+		{
+			"image/jpeg",
+			testJPEG(8, 4, 3, binary.LittleEndian),
+			[]string{"exif"}, nil, 3,
+		},
+		{
+			"image/png",
+			withChunks(testPNG(8, 4), iccp, pngChunk("tEXt", []byte("Author\x00me")), pngChunk("tIME", make([]byte, 7))),
+			[]string{"text", "time"},
+			[][]byte{iccp},
+			1,
+		},
+		{
+			"image/png",
+			withChunks(testPNG(8, 4), pngChunk("eXIf", exifWithGPS(6)[len(exifHeader):])),
+			[]string{"exif", "gps"}, nil, 6,
+		},
+		{
+			"image/png",
+			testPNG(8, 4),
+			nil, nil, 1,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			out, removed, err := stripMetadata(tc.mimeType, tc.data)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.removed, removed)
+			for _, kept := range tc.kept {
+				assert.True(t, bytes.Contains(out, kept))
+			}
+			assert.Equal(t, tc.orientation, imageOrientation(tc.mimeType, out))
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(out))
+			assert.Nil(t, err)
+			assert.Equal(t, 8, config.Width)
+		})
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	// extended format: VP8X announcing EXIF and XMP, the 1x1 image, metadata
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP
+	b := []byte("RIFF\x00\x00\x00\x00WEBP")
+	b = append(b, webpChunk("VP8X", vp8x)...)
+	b = append(b, testWebP[12:]...)
+	b = append(b, webpChunk("EXIF", exifWithGPS(1)[len(exifHeader):])...)
+	b = append(b, webpChunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+
+	out, removed, err := stripMetadata("image/webp", b)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"exif", "gps", "xmp"}, removed)
+	// the flags are cleared, the image is left alone
+	assert.Equal(t, append(webpChunk("VP8X", make([]byte, 10)), testWebP[12:]...), out[12:])
+	assert.Equal(t, uint32(len(out)-8), binary.LittleEndian.Uint32(out[4:]))
+
+	// an orientation stays behind in an EXIF of its own
+	rotated := withWebPExif(testWebP, exifWithGPS(6)[len(exifHeader):])
+	out, removed, err = stripMetadata("image/webp", rotated)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"exif", "gps"}, removed)
+	assert.Equal(t, 6, imageOrientation("image/webp", out))
+	assert.Equal(t, byte(webpFlagEXIF), out[20])
+	// the decoder reads no extended WebP but one with alpha
+	_, err = decodeImage(bytes.NewReader(out))
+	assert.Nil(t, err)
+
+	// WebP can not be written, normalizing leaves the orientation
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{StripMetadata: true, NormalizeOrientation: true})
+	info, err := s.Save(File{Name: "r.webp", Type: "image/webp", Content: bytes.NewReader(rotated)})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"exif", "gps"}, info.Stripped)
+	obj, _, err := s.Open(info.Name)
+	assert.Nil(t, err)
+	stored, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	assert.Equal(t, 6, imageOrientation("image/webp", stored))
+}
+
+// withWebPExif turns a simple WebP into an extended one with an EXIF chunk.
+func withWebPExif(b, tiff []byte) []byte {
+	config, _ := webp.DecodeConfig(bytes.NewReader(b))
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF
+	vp8x[4], vp8x[7] = byte(config.Width-1), byte(config.Height-1)
+	out := append([]byte{}, b[:12]...)
+	out = append(out, webpChunk("VP8X", vp8x)...)
+	out = append(out, b[12:]...)
+	out = append(out, webpChunk("EXIF", tiff)...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+// tiffEntry is an IFD entry of a little endian TIFF, value holds the value
+// or its offset.
+type tiffEntry struct {
+	tag, kind    uint16
+	count, value uint32
+}
+
+// withTIFFTags appends a copy of IFD0 of a little endian TIFF with more
+// entries and points the header at it.
+func withTIFFTags(b []byte, extra ...tiffEntry) []byte {
+	ifd := int(binary.LittleEndian.Uint32(b[4:8]))
+	count := int(binary.LittleEndian.Uint16(b[ifd:]))
+	var entries []tiffEntry
+	for i := 0; i < count; i++ {
+		e := b[ifd+2+i*12:]
+		entries = append(entries, tiffEntry{
+			binary.LittleEndian.Uint16(e), binary.LittleEndian.Uint16(e[2:]),
+			binary.LittleEndian.Uint32(e[4:]), binary.LittleEndian.Uint32(e[8:]),
+		})
+	}
+	entries = append(entries, extra...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	out := append([]byte{}, b...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)))
+	out = append(out, 0, 0)
+	binary.LittleEndian.PutUint16(out[len(out)-2:], uint16(len(entries)))
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		binary.LittleEndian.PutUint16(entry, e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.kind)
+		binary.LittleEndian.PutUint32(entry[4:], e.count)
+		binary.LittleEndian.PutUint32(entry[8:], e.value)
+		out = append(out, entry...)
+	}
+	return append(out, 0, 0, 0, 0)
+}
+
+func TestStripTIFF(t *testing.T) {
+	var buff bytes.Buffer
+	tiff.Encode(&buff, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil)
+	b := buff.Bytes()
+	// an empty GPS IFD and a profile at the end, pointed at by the new IFD0
+	gps := uint32(len(b))
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	profile := []byte("icc profile")
+	icc := uint32(len(b))
+	b = append(b, profile...)
+	b = withTIFFTags(b,
+		tiffEntry{exifOrientationTag, 3, 1, 6},
+		tiffEntry{305, 2, 4, binary.LittleEndian.Uint32([]byte("cam\x00"))},
+		tiffEntry{exifGPSTag, 4, 1, gps},
+		tiffEntry{tiffICCTag, 7, uint32(len(profile)), icc},
+	)
+	tags := tiffTags(b, exifGPSTag, exifOrientationTag)
+	assert.Equal(t, map[uint16]uint32{exifGPSTag: gps, exifOrientationTag: 6}, tags)
+
+	out, removed, err := stripMetadata("image/tiff", b)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"gps", "text"}, removed)
+	assert.Empty(t, tiffTags(out, exifGPSTag, 305))
+	// the orientation and the profile are kept as tags
+	assert.Equal(t, 6, imageOrientation("image/tiff", out))
+	field, ok := tiffFieldOf(out, tiffICCTag)
+	assert.True(t, ok)
+	assert.Equal(t, profile, field.value)
+	config, err := tiff.DecodeConfig(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(8, 4), image.Pt(config.Width, config.Height))
+	img, err := decodeImage(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(4, 8), img.Bounds().Size())
+
+	plain := buff.Bytes()
+	out, removed, err = stripMetadata("image/tiff", plain)
+	assert.Nil(t, err)
+	assert.Nil(t, removed)
+	assert.Equal(t, plain, out)
+}
+
+// gifExtension builds an extension block with one data sub-block.
+func gifExtension(label byte, header, data []byte) []byte {
+	block := []byte{0x21, label}
+	if header != nil {
+		block = append(append(block, byte(len(header))), header...)
+	}
+	return append(append(append(block, byte(len(data))), data...), 0)
+}
+
+func TestStripGIF(t *testing.T) {
+	var buff bytes.Buffer
+	img := image.NewPaletted(image.Rect(0, 0, 8, 4), []color.Color{color.Black, color.White})
+	gif.EncodeAll(&buff, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}, LoopCount: 0})
+	b := buff.Bytes()
+	// metadata goes right after the screen descriptor
+	first := 13 + gifColorTable(b[10])
+	metadata := append(gifExtension(0xfe, nil, []byte("taken at home")), gifExtension(0xff, []byte("XMP DataXMP"), []byte("<x:xmpmeta/>"))...)
+	metadata = append(metadata, gifExtension(0xff, []byte("CAMERA01abc"), []byte("data"))...)
+	data := append(append(append([]byte{}, b[:first]...), metadata...), b[first:]...)
+
+	out, removed, err := stripMetadata("image/gif", data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"application", "comment", "xmp"}, removed)
+	assert.Equal(t, b, out)
+	decoded, err := gif.DecodeAll(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Len(t, decoded.Image, 2)
+
+	out, removed, err = stripMetadata("image/gif", b)
+	assert.Nil(t, err)
+	assert.Nil(t, removed)
+	assert.Equal(t, b, out)
+}
+
+func TestStripMetadataMalformed(t *testing.T) {
+	_, _, err := stripMetadata("image/jpeg", []byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff})
+	assert.Equal(t, errBadImage, err)
+	_, _, err = stripMetadata("image/png", append(append([]byte{}, pngSignature...), 0, 0, 1))
+	assert.Equal(t, errBadImage, err)
+	_, _, err = stripMetadata("image/gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00\x21\xfe\x05ab"))
+	assert.Equal(t, errBadImage, err)
+	_, _, err = stripMetadata("image/svg+xml", []byte("<svg/>"))
+	assert.Error(t, err)
+}
+
+func TestSaveStripMetadata(t *testing.T) {
+	files := []File{
+		{Name: "gps.jpg", Type: "image/jpeg", Content: bytes.NewReader(withSegments(testJPEG(40, 20, 0, binary.BigEndian), jpegSegment(0xe1, exifWithGPS(6))))},
+		{Name: "gps.png", Type: "image/png", Content: bytes.NewReader(withChunks(testPNG(40, 20), pngChunk("eXIf", exifWithGPS(6)[len(exifHeader):])))},
+	}
+	keep := false
+	normalize := true
+
+	cases := []struct {
+		options   Options
+		strip     *bool
+		normalize *bool
+		stripped  []string
+		gps       bool
+		size      image.Point
+	}{
+		{Options{}, nil, nil, nil, true, image.Pt(40, 20)},
+		{Options{StripMetadata: true}, nil, nil, []string{"exif", "gps"}, false, image.Pt(40, 20)},
+		{Options{StripMetadata: true}, &keep, nil, nil, true, image.Pt(40, 20)},
+		{Options{StripMetadata: true}, nil, &normalize, []string{"exif", "gps"}, false, image.Pt(20, 40)},
+		{Options{}, nil, &normalize, nil, true, image.Pt(20, 40)},
+	}
+
+	for _, file := range files {
+		for i, tc := range cases {
+			t.Run(fmt.Sprintf("%s case %d", file.Name, i), func(t *testing.T) {
+				file.Content.(*bytes.Reader).Seek(0, io.SeekStart)
+				file.Strip = tc.strip
+				file.Normalize = tc.normalize
+				s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), tc.options)
+				info, err := s.Save(file)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.stripped, info.Stripped)
+
+				obj, _, err := s.Open(info.Name)
+				assert.Nil(t, err)
+				stored, _ := ioutil.ReadAll(obj)
+				obj.Close()
+				_, gps := tiffTags(exifOf(file.Type, stored), exifGPSTag)[exifGPSTag]
+				assert.Equal(t, tc.gps, gps)
+
+				img, err := decodeImage(bytes.NewReader(stored))
+				assert.Nil(t, err)
+				assert.Equal(t, image.Pt(20, 40), img.Bounds().Size())
+				config, _, err := image.DecodeConfig(bytes.NewReader(stored))
+				assert.Nil(t, err)
+				assert.Equal(t, tc.size, image.Pt(config.Width, config.Height))
+			})
+		}
+	}
+}
+
+// exifOf returns the TIFF structure of the EXIF of a JPEG or PNG.
+func exifOf(mimeType string, b []byte) []byte {
+	var tiff []byte
+	switch mimeType {
+	case "image/jpeg":
+		tiff = bytes.TrimPrefix(exifPayload(b), exifHeader)
+	case "image/png":
+		pngChunks(b, func(kind string, chunk []byte) {
+			if kind == "eXIf" {
+				tiff = chunk[8 : len(chunk)-4]
+			}
+		})
+	}
+	return tiff
+}
+
+func exifPayload(b []byte) []byte {
+	var payload []byte
+	jpegSegments(b, func(marker byte, segment []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(segment[4:], exifHeader) {
+			payload = segment[4:]
+			return false
+		}
+		return true
+	})
+	return payload
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxNameLength = 200
+
+type Naming string
+
+const (
+	NamingOriginal Naming = "original"
+	NamingUUID     Naming = "uuid"
+	NamingULID     Naming = "ulid"
+)
+
+type Collision string
+
+const (
+	CollisionReject    Collision = "reject"
+	CollisionOverwrite Collision = "overwrite"
+	CollisionRename    Collision = "rename"
+)
+
+var (
+	ErrBadNaming    = newError(http.StatusBadRequest, "bad_naming", "naming should be one of original, uuid, ulid")
+	ErrBadCollision = newError(http.StatusBadRequest, "bad_collision", "collision should be one of reject, overwrite, rename")
+)
+
+func ParseNaming(s string) (Naming, error) {
+	switch Naming(s) {
+	case "", NamingOriginal:
+		return NamingOriginal, nil
+	case NamingUUID, NamingULID:
+		return Naming(s), nil
+	default:
+		return "", ErrBadNaming
+	}
+}
+
+func ParseCollision(s string) (Collision, error) {
+	switch Collision(s) {
+	case "", CollisionReject:
+		return CollisionReject, nil
+	case CollisionOverwrite, CollisionRename:
+		return Collision(s), nil
+	default:
+		return "", ErrBadCollision
+	}
+}
+
+// SanitizeName turns a client supplied file name into a safe flat name.
+// Compatibility forms are folded first (NFKC), so fullwidth dots and
+// slashes become plain ones before the checks. It returns an empty string
+// when nothing usable is left.
+func SanitizeName(name string) string {
+	name = norm.NFKC.String(name)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	underscore := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r), strings.ContainsRune(`<>:"|*?#`, r):
+			if !underscore {
+				b.WriteRune('_')
+			}
+			underscore = true
+			continue
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			continue
+		}
+		underscore = false
+		b.WriteRune(r)
+	}
+	name = strings.TrimLeft(b.String(), "._-")
+	name = strings.TrimRight(name, "._")
+
+	if len(name) > maxNameLength {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := name[:maxNameLength-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	if !checkName(name) {
+		return ""
+	}
+	return name
+}
+
+// NameFromURL takes the last path segment of a url, without the query
+// string or fragment. It is empty when the path has no segments.
+func NameFromURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return nameFromPath(u.Path)
+}
+
+// NameFromResponse names a fetched file after the Content-Disposition
+// filename, or else the last path segment of the url it was fetched from
+// after redirects. An extension not matching the detected type is dropped,
+// so nameFor gives it the extension of the type instead.
+func NameFromResponse(fetched *Fetched, mimeType string) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(fetched.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" && fetched.URL != nil {
+		name = nameFromPath(fetched.URL.Path)
+	}
+	f, ok := formatFor(mimeType)
+	ext := path.Ext(name)
+	if !ok || ext == "" || strings.EqualFold(ext, f.Ext) {
+		return name
+	}
+	if extType, ok := formatFor(mime.TypeByExtension(strings.ToLower(ext))); ok && extType.Type == f.Type {
+		return name
+	}
+	return strings.TrimSuffix(name, ext)
+}
+
+func nameFromPath(p string) string {
+	name := path.Base(p)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// nameFor picks the stored name for a new file, falling back to a generated
+// one when the original does not survive sanitizing.
+func nameFor(original, mimeType string, naming Naming) string {
+	name := SanitizeName(original)
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		if f, ok := formatFor(mimeType); ok {
+			ext = f.Ext
+		} else if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+			ext = preferredExt(exts)
+		}
+	}
+
+	switch {
+	case naming == NamingUUID:
+		return newUUID() + ext
+	case naming == NamingULID, name == "":
+		return newULID(time.Now()) + ext
+	case path.Ext(name) == "":
+		return name + ext
+	default:
+		return name
+	}
+}
+
+func renamed(name string, n int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+func preferredExt(exts []string) string {
+	for _, ext := range exts {
+		if ext == ".jpg" || ext == ".png" || ext == ".gif" {
+			return ext
+		}
+	}
+	return exts[0]
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func newULID(t time.Time) string {
+	var b [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	rand.Read(b[6:])
+
+	// 128 bits as 26 base32 characters, the first one carries 3 bits
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
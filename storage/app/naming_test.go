@@ -0,0 +1,144 @@
+package app
+
+import (
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeName(t *testing.T) {
+	cases := []struct {
+		name   string
+		result string
+	}{
+		{"photo.png", "photo.png"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\me\photo.png`, "photo.png"},
+		{"..", ""},
+		{"", ""},
+		{"...png", "png"},
+		{".hidden.png", "hidden.png"},
+		{"my  holiday photo.png", "my_holiday_photo.png"},
+		{"what?.png", "what_.png"},
+		{"\uff0e\uff0e\uff0fsecret.png", "secret.png"},
+		{"evil\u202egnp.exe", "evilgnp.exe"},
+		{"tab\tnew\nline.png", "tab_new_line.png"},
+		{"фото.jpg", "фото.jpg"},
+		{strings.Repeat("a", 300) + ".png", strings.Repeat("a", 196) + ".png"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.result, SanitizeName(tc.name))
+		})
+	}
+}
+
+func TestNameFromURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		name string
+	}{
+		{"https://x/img.png", "img.png"},
+		{"https://x/img?id=5", "img"},
+		{"https://x/a/b.jpg#top", "b.jpg"},
+		{"https://x/%D1%84.png", "ф.png"},
+		{"https://x/", ""},
+		{"https://x", ""},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			assert.Equal(t, tc.name, NameFromURL(tc.url))
+		})
+	}
+}
+
+func TestNameFromResponse(t *testing.T) {
+	cases := []struct {
+		url         string
+		disposition string
+		mimeType    string
+		name        string
+	}{
+		{"https://x/img.png", "", "image/png", "img.png"},
+		{"https://x/img?id=5", "", "image/png", "img"},
+		{"https://x/", "", "image/png", ""},
+		{"https://x/photo.JPEG", "", "image/jpeg", "photo.JPEG"},
+		{"https://x/scan.tif", "", "image/tiff", "scan.tif"},
+		{"https://x/image.php", "", "image/png", "image"},
+		{"https://x/photo.png", "", "image/jpeg", "photo"},
+		{"https://x/download", `attachment; filename="cat.gif"`, "image/gif", "cat.gif"},
+		{"https://x/download", `attachment; filename*=UTF-8''%D1%84.png`, "image/png", "ф.png"},
+		{"https://x/download", `attachment; filename="cat.png"`, "image/webp", "cat"},
+		{"https://x/img.png", `inline`, "image/png", "img.png"},
+		{"https://x/img.png", `attachment; filename=`, "image/png", "img.png"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			u, _ := url.Parse(tc.url)
+			header := http.Header{}
+			if tc.disposition != "" {
+				header.Set("Content-Disposition", tc.disposition)
+			}
+			assert.Equal(t, tc.name, NameFromResponse(&Fetched{URL: u, Header: header}, tc.mimeType))
+		})
+	}
+}
+
+func TestNameFor(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\.png$`)
+	ulid := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}\.(png|jpg)$`)
+
+	assert.Equal(t, "img.png", nameFor("img", "image/png", NamingOriginal))
+	assert.Equal(t, "img.JPG", nameFor("img.JPG", "image/jpeg", NamingOriginal))
+	assert.Regexp(t, uuid, nameFor("img.PNG", "image/png", NamingUUID))
+	assert.Regexp(t, ulid, nameFor("img.png", "image/png", NamingULID))
+	assert.Regexp(t, ulid, nameFor("..", "image/jpeg", NamingOriginal))
+}
+
+func TestNewULID(t *testing.T) {
+	at := time.Unix(1469918176, 385000000)
+	id := newULID(at)
+	assert.Len(t, id, 26)
+	assert.Equal(t, "01ARYZ6S41", id[:10])
+	assert.True(t, newULID(at.Add(time.Millisecond)) > id)
+}
+
+func TestSaveCollision(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+	cases := []struct {
+		content   string
+		collision Collision
+		name      string
+		err       error
+	}{
+		{"1", CollisionReject, "a.png", nil},
+		{"1", CollisionReject, "a.png", nil},
+		{"2", CollisionReject, "", ErrExists},
+		{"2", CollisionRename, "a-1.png", nil},
+		{"3", CollisionRename, "a-2.png", nil},
+		{"2", CollisionRename, "a-1.png", nil},
+		{"4", CollisionOverwrite, "a.png", nil},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			info, err := s.Save(File{
+				Name:      "a.png",
+				Type:      "image/png",
+				Content:   strings.NewReader(tc.content),
+				Collision: tc.collision,
+			})
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.name, info.Name)
+		})
+	}
+}
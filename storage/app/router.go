@@ -2,30 +2,63 @@ package app
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"path"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
-func NewRouter() *gin.Engine {
+const (
+	// sniffLen is what http.DetectContentType looks at
+	sniffLen = 512
+	// maxFieldSize bounds the non-file fields of a streamed form
+	maxFieldSize = 4 << 10
+)
+
+// handlers serve the API from one service.
+type handlers struct {
+	service *service
+}
+
+func NewRouter(s *service) *gin.Engine {
 	router := gin.Default()
-	setupRouter(router)
+	setupRouter(router, s)
 	return router
 }
 
-func setupRouter(router *gin.Engine) {
+func setupRouter(router *gin.Engine, s *service) {
+	h := handlers{service: s}
 	api := router.Group("/storage")
 
 	api.GET("/ping", ping)
-	api.POST("/upload", upload)
-	api.POST("/upload/link", link)
-	api.POST("/upload/json", json)
+	api.GET("/images", h.list)
+	api.GET("/images/:name", h.download)
+	api.HEAD("/images/:name", h.download)
+	api.GET("/images/:name/:variant", h.downloadVariant)
+	api.HEAD("/images/:name/:variant", h.downloadVariant)
+	api.DELETE("/images/:name", h.remove)
+	api.POST("/upload", h.accepting, h.upload)
+	api.POST("/upload/link", h.accepting, h.link)
+	api.POST("/upload/links", h.accepting, h.links)
+	api.POST("/upload/json", h.accepting, h.json)
+	api.POST("/sessions", h.accepting, h.sessionCreate)
+	api.GET("/sessions/:id", h.sessionGet)
+	api.DELETE("/sessions/:id", h.sessionAbort)
+	api.PUT("/sessions/:id/chunks/:n", h.accepting, h.sessionChunk)
+	api.POST("/sessions/:id/finalize", h.accepting, h.sessionFinalize)
+
+	tus := api.Group("/tus", tusResumable)
+	tus.OPTIONS("/", h.tusOptionsHandler)
+	tus.POST("/", h.accepting, h.tusCreate)
+	tus.HEAD("/:id", h.tusHead)
+	tus.PATCH("/:id", h.accepting, h.tusPatch)
+	tus.DELETE("/:id", h.tusTerminate)
 }
 
 func ping(c *gin.Context) {
@@ -34,155 +67,439 @@ func ping(c *gin.Context) {
 	})
 }
 
-func upload(c *gin.Context) {
-	form, err := c.MultipartForm()
+func (h handlers) list(c *gin.Context) {
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			errorResponse(c, "limit should be a positive number")
+			return
+		}
+	}
+	files, err := h.service.List(ListQuery{
+		Limit:  limit,
+		Cursor: c.Query("cursor"),
+		Type:   c.Query("type"),
+		Sort:   c.Query("sort"),
+	})
 	if err != nil {
-		errorResponse(c, fmt.Sprintf("get form err: %s", err.Error()))
+		problemResponse(c, err, nil)
 		return
 	}
 
-	files := form.File["images[]"]
-	var paths []FileDTO
-	for _, file := range files {
-		reader, err := file.Open()
+	c.JSON(http.StatusOK, files)
+}
+
+func (h handlers) download(c *gin.Context) {
+	var f Object
+	var info FileInfo
+	t, ok, err := transformQuery(c)
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+	if ok {
+		f, info, err = h.service.Transform(c.Param("name"), t)
+	} else {
+		f, info, err = h.service.Open(c.Param("name"))
+	}
+	serve(c, f, info, err)
+}
+
+func (h handlers) downloadVariant(c *gin.Context) {
+	f, info, err := h.service.OpenVariant(c.Param("name"), c.Param("variant"))
+	serve(c, f, info, err)
+}
+
+func serve(c *gin.Context, f Object, info FileInfo, err error) {
+	if err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+	defer f.Close()
+
+	// ServeContent answers HEAD, Range and conditional requests from the
+	// ETag and Last-Modified set here
+	c.Header("Content-Type", info.Type)
+	c.Header("ETag", etag(info))
+	http.ServeContent(c.Writer, c.Request, info.Name, info.Modified, f)
+}
+
+// transformQuery reads w, h, fit, format and q, ok is false when none of
+// them is set.
+func transformQuery(c *gin.Context) (t Transform, ok bool, err error) {
+	if w := c.Query("w"); w != "" {
+		ok = true
+		size, err := strconv.ParseUint(w, 10, 32)
 		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not open file to read: %s", err.Error()))
-			return
+			return t, ok, fmt.Errorf("bad width %q", w)
 		}
-		b, err := ioutil.ReadAll(reader)
+		t.Width = uint(size)
+	}
+	if h := c.Query("h"); h != "" {
+		ok = true
+		size, err := strconv.ParseUint(h, 10, 32)
 		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not read file: %s", err.Error()))
-			return
+			return t, ok, fmt.Errorf("bad height %q", h)
 		}
-		name := html.UnescapeString(file.Filename)
-		img, err := Service.SaveFile(File{
-			Name:    name,
-			Size:    int(file.Size),
-			Type:    http.DetectContentType(b),
-			Content: bytes.NewReader(b),
-		})
-		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not save file: %s", err.Error()))
-			return
+		t.Height = uint(size)
+	}
+	if q := c.Query("q"); q != "" {
+		ok = true
+		if t.Quality, err = strconv.Atoi(q); err != nil {
+			return t, ok, fmt.Errorf("bad quality %q", q)
 		}
-		resize, err := Service.Resize(File{
-			Name:    name,
-			Size:    int(file.Size),
-			Type:    http.DetectContentType(b),
-			Content: bytes.NewReader(b),
+	}
+	if fit := c.Query("fit"); fit != "" {
+		ok = true
+		t.Fit = Fit(fit)
+	}
+	if format := c.Query("format"); format != "" {
+		ok = true
+		t.Format = format
+		if !strings.Contains(format, "/") {
+			t.Format = "image/" + strings.ToLower(format)
+		}
+	}
+	return t, ok, nil
+}
+
+func (h handlers) remove(c *gin.Context) {
+	name := c.Param("name")
+	deleted, err := h.service.Delete(name)
+	if derr, ok := err.(*DeleteError); ok {
+		problemResponse(c, err, gin.H{
+			"deleted": derr.Deleted,
+			"failed":  derr.Failed,
 		})
+		return
+	}
+	if err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"name":    name,
+		"deleted": deleted,
+	})
+}
+
+// upload streams a multipart form. Fields are read as they come, so the
+// save options have to be in the query or precede the files.
+func (h handlers) upload(c *gin.Context) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		errorResponse(c, fmt.Sprintf("get form err: %s", err.Error()))
+		return
+	}
+
+	form := url.Values{}
+	var options File
+	var batch *uploadBatch
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not resize file: %s", err.Error()))
+			errorResponse(c, fmt.Sprintf("get form err: %s", err.Error()))
 			return
 		}
+		if part.FormName() != "images[]" || part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			part.Close()
+			if err != nil || len(value) > maxFieldSize {
+				errorResponse(c, fmt.Sprintf("bad form field %q", part.FormName()))
+				return
+			}
+			form.Add(part.FormName(), string(value))
+			continue
+		}
 
-		paths = append(paths, FileDTO{
-			Name:   name,
-			Path:   img,
-			Resize: resize,
-		})
+		if batch == nil {
+			if options, err = saveOptions(partParams(c, form)); err == nil {
+				batch, err = h.newBatch(partParams(c, form), options)
+			}
+			if err != nil {
+				errorResponse(c, err.Error())
+				return
+			}
+		}
+		name := html.UnescapeString(part.FileName())
+		if batch.stopped() {
+			part.Close()
+			batch.skip(name)
+			continue
+		}
+		upload := options
+		upload.Name = name
+		batch.saveReader(upload, part)
+		part.Close()
 	}
-
-	// success
-	c.JSON(http.StatusOK, paths)
+	if batch == nil {
+		batch = newUploadBatch(h.service, false)
+	}
+	batch.respond(c)
 }
 
-func link(c *gin.Context) {
+func (h handlers) link(c *gin.Context) {
 	url := c.PostForm("url")
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	options, err := saveOptions(formParams(c))
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
 	}
-	client := &http.Client{Transport: tr}
-	file, err := client.Get(url)
+	fetched, err := h.service.Fetch(url)
 	if err != nil {
-		errorResponse(c, fmt.Sprintf("error downloading file: %s", err.Error()))
+		problemResponse(c, err, nil)
 		return
 	}
-	defer file.Body.Close()
-
-	content, err := ioutil.ReadAll(file.Body)
+	content := fetched.Content
 	var paths []FileDTO
-	img, err := Service.SaveFile(File{
-		Name:    path.Base(url),
-		Size:    len(content),
-		Type:    http.DetectContentType(content),
-		Content: bytes.NewReader(content),
-	})
+	upload := options
+	upload.Type = detectType(content)
+	upload.Name = NameFromResponse(fetched, upload.Type)
+	upload.Size = len(content)
+	upload.Content = bytes.NewReader(content)
+	info, variants, err := h.service.saveUpload(upload)
 	if err != nil {
-		errorResponse(c, fmt.Sprintf("could not save file: %s", err.Error()))
+		problemResponse(c, err, nil)
 		return
 	}
-	resize, err := Service.Resize(File{
-		Name:    path.Base(url),
-		Size:    len(content),
-		Type:    http.DetectContentType(content),
-		Content: bytes.NewReader(content),
-	})
-	paths = append(paths, FileDTO{
-		Name:   path.Base(url),
-		Path:   img,
-		Resize: resize,
-	})
+	paths = append(paths, h.service.fileDTO(info, variants))
 	// success
 	c.JSON(http.StatusOK, paths)
 }
 
-func json(c *gin.Context) {
+// links imports a JSON list of urls, fetched concurrently, reporting each
+// one instead of stopping at the first failure.
+func (h handlers) links(c *gin.Context) {
+	var data []struct {
+		URL  string `json:"url"`
+		Name string `json:"name"`
+	}
+	if err := h.bindJSON(c, &data, "links"); err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+	if err := h.service.CheckURLs(len(data)); err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+	options, err := saveOptions(formParams(c))
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+
+	urls := make([]string, len(data))
+	for i, item := range data {
+		urls[i] = item.URL
+	}
+	results := make([]LinkResultDTO, len(data))
+	h.service.FetchAll(urls, func(i int, fetched *Fetched, err error) {
+		results[i].URL = urls[i]
+		if err != nil {
+			results[i].fail(err)
+			return
+		}
+		content := fetched.Content
+		upload := options
+		upload.Type = detectType(content)
+		upload.Name = data[i].Name
+		if upload.Name == "" {
+			upload.Name = NameFromResponse(fetched, upload.Type)
+		}
+		upload.Size = len(content)
+		upload.Content = bytes.NewReader(content)
+		info, variants, err := h.service.saveUpload(upload)
+		if err != nil {
+			results[i].fail(err)
+			return
+		}
+		dto := h.service.fileDTO(info, variants)
+		results[i].Status = http.StatusOK
+		results[i].File = &dto
+	})
+	c.JSON(http.StatusOK, results)
+}
+
+func (h handlers) json(c *gin.Context) {
 	data := new([]struct {
 		Name    string `json:"name" binding:"required"`
 		Size    int    `json:"size" binding:"required"`
 		Type    string `json:"type" binding:"required"`
 		Content string `json:"content" binding:"required"`
 	})
-	err := c.BindJSON(data)
-	if err != nil {
-		errorResponse(c, fmt.Sprintf("could not unmarshal files: %s", err.Error()))
+	if err := h.bindJSON(c, data, "files"); err != nil {
+		problemResponse(c, err, nil)
 		return
 	}
 
-	var paths []FileDTO
+	options, err := saveOptions(formParams(c))
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+	batch, err := h.newBatch(formParams(c), options)
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
 	for _, file := range *data {
+		name := html.UnescapeString(file.Name)
+		if batch.stopped() {
+			batch.skip(name)
+			continue
+		}
 		// Get base64 value
 		b64data := file.Content[strings.IndexByte(file.Content, ',')+1:]
+		// decoded size, checked before decoding
+		if err := h.service.CheckSize(int64(len(strings.TrimRight(b64data, "=")) * 3 / 4)); err != nil {
+			batch.reject(name, err)
+			continue
+		}
 		data, err := base64.StdEncoding.DecodeString(b64data)
 		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not decode base64 file string: %s", err.Error()))
-			return
+			batch.reject(name, badRequest(fmt.Sprintf("could not decode base64 file string: %s", err.Error())))
+			continue
 		}
-		name := html.UnescapeString(file.Name)
-		img, err := Service.SaveFile(File{
-			Name:    name,
-			Size:    int(file.Size),
-			Type:    file.Type,
-			Content: bytes.NewReader(data),
-		})
-		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not save file: %s", err.Error()))
-			return
+		upload := options
+		upload.Name = name
+		upload.Size = int(file.Size)
+		upload.Type = file.Type
+		upload.Content = bytes.NewReader(data)
+		batch.save(upload)
+	}
+	batch.respond(c)
+}
+
+// jsonSlack is the room a JSON body has for everything but the base64
+// content of a file.
+const jsonSlack = 64 << 10
+
+// bindJSON binds a JSON body of what, read no further than the base64 of a
+// file at the byte limit and the slack, so a JSON request holds no more
+// content than one file may have. A longer body is answered with 413.
+func (h handlers) bindJSON(c *gin.Context, v interface{}, what string) error {
+	if max := h.service.MaxBytes(); max > 0 {
+		limit := int64(base64.StdEncoding.EncodedLen(int(max))) + jsonSlack
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+	err := c.ShouldBindJSON(v)
+	if err == nil {
+		return nil
+	}
+	// the error of http.MaxBytesReader has no type before Go 1.19
+	if strings.HasSuffix(err.Error(), "request body too large") {
+		return ErrTooLarge.with("request body is too large")
+	}
+	return badRequest(fmt.Sprintf("could not unmarshal %s: %s", what, err.Error()))
+}
+
+func (s service) fileDTO(info FileInfo, variants map[string]string) FileDTO {
+	dto := FileDTO{
+		Name:     info.Name,
+		Path:     s.path(info.Name),
+		Resize:   s.ThumbnailPath(info.Name),
+		Variants: variants,
+		Hash:     info.Hash,
+		Stripped: info.Stripped,
+	}
+	if info.Source != "" {
+		dto.Source = s.path(info.Source)
+	}
+	return dto
+}
+
+// etag is a strong validator, the content hash of the served bytes.
+func etag(info FileInfo) string {
+	return `"` + info.Hash + `"`
+}
+
+// params looks request parameters up by name.
+type params func(key string) string
+
+// formParams reads the query, then the form.
+func formParams(c *gin.Context) params {
+	return func(key string) string {
+		if value, ok := c.GetQuery(key); ok {
+			return value
 		}
-		resize, err := Service.Resize(File{
-			Name:    name,
-			Size:    int(file.Size),
-			Type:    file.Type,
-			Content: bytes.NewReader(data),
-		})
-		if err != nil {
-			errorResponse(c, fmt.Sprintf("could not resize file: %s", err.Error()))
-			return
+		return c.PostForm(key)
+	}
+}
+
+// partParams reads the query, then the form fields streamed so far.
+func partParams(c *gin.Context, form url.Values) params {
+	return func(key string) string {
+		if value, ok := c.GetQuery(key); ok {
+			return value
 		}
+		return form.Get(key)
+	}
+}
 
-		paths = append(paths, FileDTO{
-			Name:   name,
-			Path:   img,
-			Resize: resize,
-		})
+// saveOptions reads the per upload options from the query or form into an
+// otherwise empty File.
+func saveOptions(param params) (File, error) {
+	naming, err := ParseNaming(param("naming"))
+	if err != nil {
+		return File{}, err
+	}
+	collision, err := ParseCollision(param("collision"))
+	if err != nil {
+		return File{}, err
+	}
+	options := File{Naming: naming, Collision: collision}
+	if options.Normalize, err = boolParam(param, "normalize"); err != nil {
+		return File{}, err
+	}
+	if options.Strip, err = boolParam(param, "strip"); err != nil {
+		return File{}, err
+	}
+	if v := param("format"); v != "" {
+		if options.Format, err = ParseFormat(v); err != nil {
+			return File{}, err
+		}
+	}
+	if v := param("quality"); v != "" {
+		if options.Quality, err = ParseQuality(v); err != nil {
+			return File{}, err
+		}
+	}
+	if options.KeepSource, err = boolParam(param, "keep_source"); err != nil {
+		return File{}, err
+	}
+	return options, nil
+}
 
+// newBatch reads the atomic parameter. Atomic uploads can not overwrite,
+// the replaced content could not be brought back on a rollback.
+func (h handlers) newBatch(param params, options File) (*uploadBatch, error) {
+	atomic, err := boolParam(param, "atomic")
+	if err != nil {
+		return nil, err
 	}
-	c.JSON(http.StatusOK, paths)
+	if !boolOr(atomic, false) {
+		return newUploadBatch(h.service, false), nil
+	}
+	if options.Collision == CollisionOverwrite {
+		return nil, ErrAtomicOverwrite
+	}
+	return newUploadBatch(h.service, true), nil
 }
 
-func errorResponse(c *gin.Context, mess string) {
-	c.JSON(http.StatusBadRequest, gin.H{
-		"message": mess,
-	})
+// boolParam is nil when the parameter is not given.
+func boolParam(param params, key string) (*bool, error) {
+	v := param(key)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s should be true or false", key)
+	}
+	return &b, nil
 }
@@ -6,6 +6,7 @@ import (
 	json2 "encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func performRequest(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
@@ -23,9 +25,28 @@ func performRequest(r http.Handler, req *http.Request) *httptest.ResponseRecorde
 	return w
 }
 
+// newTestService keeps its files in memory.
+func newTestService() *service {
+	return NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+}
+
+// uploadResult is the status and file of the single item of an upload, or
+// the response status when the whole request was turned away.
+func uploadResult(resp *httptest.ResponseRecorder) (int, FileDTO) {
+	var results []UploadResultDTO
+	if resp.Code != http.StatusOK || json2.Unmarshal(resp.Body.Bytes(), &results) != nil || len(results) != 1 {
+		return resp.Code, FileDTO{}
+	}
+	if results[0].File == nil {
+		return results[0].Status, FileDTO{}
+	}
+	return results[0].Status, *results[0].File
+}
+
 func TestNotFounded(t *testing.T) {
+	s := newTestService()
 	gin.SetMode(gin.TestMode)
-	router := NewRouter()
+	router := NewRouter(s)
 
 	req, _ := http.NewRequest("GET", "/blah", nil)
 	resp := performRequest(router, req)
@@ -33,8 +54,9 @@ func TestNotFounded(t *testing.T) {
 }
 
 func TestPing(t *testing.T) {
+	s := newTestService()
 	gin.SetMode(gin.TestMode)
-	router := NewRouter()
+	router := NewRouter(s)
 
 	req, _ := http.NewRequest("GET", "/storage/ping", nil)
 	resp := performRequest(router, req)
@@ -43,6 +65,7 @@ func TestPing(t *testing.T) {
 }
 
 func TestUpload(t *testing.T) {
+	s := newTestService()
 	cases := []struct {
 		name string
 		ext  string
@@ -53,12 +76,12 @@ func TestUpload(t *testing.T) {
 			name: "test1.png",
 			ext:  "image/png",
 			data: "iVBORw0KGgoAAAANSUhEUgAAAOEAAADhCAMAAAAJbSJIAAAAkFBMVEX/AAD/////9/f/+vr/fX3/4+P/1NT/9fX/paX//Pz/3t7/jIz/6Oj/7Oz/sbH/z8//KSn/NTX/29v/urr/nJz/wsL/FBT/8PD/kJD/x8f/Tk7/YmL/l5f/Xl7/PT3/eHj/QkL/LCz/Hh7/SEj/goL/Vlb/rq7/aWn/trb/GRn/UlL/cHD/oaH/W1v/Dg7/gYGccI8YAAAIY0lEQVR4nO2dh3qqMBSACchWcICCq646WqXv/3YXpL0KJBAgMSTt/wDt+b9Ixsk4EqCOqciyrKvu5Oh5gR2z9AzH1/q6LCuKSf3fSzT/uD5QrdA4LNaRBOWyXnwZrqUOdIpBUDPsa6Fj34ZwtSzD94MTaiql5qRiOAgd7zTCkXswWiydcEAhGPKGqmOf1vXsflifbGNMOh7ChpZ3mu+a6aVcNiePrCRJQ9143yL6lDpE2w9jRi4qYoby5L293IMPXyEUGBnD2Tgg0HhZdssxkZYkYGiqkzfSeneiN1/tgqF2JfrzzLI6WqwNteWcnl/C7dqya21nqNl7un4x0XzZZ2U4s2vOW5o6bq4tZnQtDI3LS/zu7CYvN9T9hjOzpry78isNFY3O+FDG1B43+q02MlS913yAOfZGk7VHE8PJgoVfwqf7CsNZsGUlGK+vvNozudqGGrMGvBOdNLqG5pFhA6YMj/U6nHqG6uu7UAiftebjdQzNkP4cDYuRW6MZaxjKxylrtR92Dn7+Ed+wv2Tt9cR0iT00YhtanfgE/zPt4X6MuIaMBwkIC8y1Maah1pE+5pk9XiviGYatcqC0uGAN/liGfmc60SxTHEUcQ594ppAUo5CEoTlhPlFDs/Yrx/5KQ3PCZC2Iy8ZvbdhtwaQVWxqGHReUpG3FqrjCsJvDRJaKHrXc0OVAMF4Vl85uSg2tzv9EUzZlif8yQ3XFOnRcbiWKJYaDbq0mSilZ9qMNdbuzU5ki0QGZg0Mamq/clmhPdEXtiiMNfazDPh0CtXeDMtRevPHSHtSwiDAcdG5JX80enp1CGNqsw21CUMNwwjrYRkyhk3CoocXdR5jyARsVYYbKJ+tQm2JD1sMwQ6OjaZlqdmcsQ5fT32jCvDhBLRrOOJqOFgkKQ0bB0OzO/ksTdoXsW8HQonyKizan/BQ8bygHrENsy7HCUONoyQRnOCs35Pw3mtArNTyzDo8E4xJDpcMJfHxOJYYG6+CIMAyRhv0N6+DI8CajDD3uO9KUkY8w7N9Yh0aKng435HdNkWfoQw1VDnMzKGwdZugI8hUmDF2I4azHOiySeErR0OUtBVzKqF8wVDzWQZHFKRgONqxjIsvGzBv6rEMijZszNCleQGPDImeosg6IPErWkPvkRREna8jJmYQ6rDKGAv5Ipa31bNilM9ykiLxnQwESUEVOT4ZjIfIzeTbaw1DAnjRmajwMT6yDocPhv6Eq5GcYjxfqj+FZqIXTg3syQxJ1rLhjfBvKXO+JltGbpYaaoJ+hJO3HqeFZmCxinshNDcXYrYAyuRvqXB7xwiOQE0N+DjvX5zZIDDUB14Y/7NTEMGQdBk3GiSGfBxExmcSG/J8vKSMwJS6PA+OzUCTQ5/igXjUjWQIqV7cOahMbWqxjoMtMAhrrGOjiSmIPFpLkSKawy9+UpWRye2wdj4OkCHOIBk5PUjr44gVJepIs9IB/NxQ0k/hDbChskiYlNmQdAmX+DPnnz5B//gz558+Qf36FofizNoF3LRJ+w/pQETrlnRiawh5TSIkNhd6YkSRPEnkXP8GXxDukn0WVwJh1DHTRJaAKdKELgvwb9g/F3gNeKZLQB4bSfXzzyDoKmoTCn6exEkOxrlZm2d7PRFnCXVt7sLqfa9MPrOOgh62Lfr70LPoZ4bgrvRu6G9aB0GJupYYDQa/MSNJB/75vIeys5vhzo8Th4tnu+mz/35mxBM233azfc3cNkK/m2wXSa7KpoSbk1PT5DikQ8kN8vgcs5HiRvcst4kHh7H18Ed9U+Mi+GnFlHQ95llnDAet4yDPIGprCXWD7/pEK/MZQmDcU7Z2okZI3NAXLZVxB3lCwi5YXq2goCzWvebx++fRuInd1V8p4PH75ZMj3c/NZTn2YoUDJjOipRsKz4UyYpf5ChRuCsyCNeDEAwlAW5A7UrY8yFGTqtnMA0lCMbMZNKTF0WUdHgmzZznxtBAG60zdQamhxP7GZDsoNTe7TGR4oN+T+tZrVoMqQ82F/V6i9Bqn3xPXL5Rj1nn5BzS4ArtyeXLjkSyEhDPmtndeDlLGE1z/kNGWzhxU+htew5LMoUgSpDYisQ8plf3qAqiAMVQ4XGWt4WWdUPWCfv/7UhZugDPk7OVy3pjN3x7+XMkIEXVu9z1X6tJefcGMYgjFHeamThdQoMQTahnXguMwRVcerDIHGSYc6KhEsN+TlokKZYIUhHwnUQoHcOoZg0vnM1LBcsNLQdDpeGGIELRlfwxAox0634ugMKadezxAoTocVR2elKv5qQ2B29+3IoV/VgliGHX5LuaKTwTcEfjdPSSPWS00MO5lhXMOyMo0NgfvBWijPe+lMpr4h0Lq17xZ94rVgDUOgfrG2eiKy1eqI6xqCWXfqeEYGPOvU0hAoXakptMMYBhsZxh9jJ64Mr9AL+taGQA+Yv+A+NConam0M48Gf7bARLbCG+TaGoH9guEk8WuJ3MY0N4yUjs7dCFlWLQTKG8dDoMdl+21yxB8G2hkB2GWyiHrQaY0Rbw7hTffXYuA9RaXtKhvH4/8qLp1OjUfu1M4x71d5r2jFaF8+QvMYQgPDtBV3OPmjSwRAyBIp/oJxtnC9xl0l0DONu1Q8otuPNaOlHwDB21I6UJuSfk1a/T2KG8Sxn4FLYTv3Sas/QYBAxTJgtiXasm3PD4a8AMcMYNZgPSYyRw7mH3LOuD0nDGC1YrVttq142p6Du+qgcwobxN+ka9qlh77pd2QZmjhAf4oYJ/dAJ3mt+lttFcPQJdJ0FqBjGyJYbOvYNa7F82b8dQ02tl5zAhpbhHX2gjn3jsEL+aHfzN8O11P6s8by6GqqGKaYiy3pfCydHL/jq9ewEzwnHM1mWFYpq3/wDy8x54GS8+O4AAAAASUVORK5CYII=",
-			resp: `[{"name":"test1.png","path":"/images/test1.png","resize":"/images/thumb_test1.png"}]`,
+			resp: `[{"name":"test1.png","status":200,"file":{"name":"test1.png","path":"/images/test1.png","resize":"/images/test1.png/thumb","variants":{"thumb":"/images/test1.png/thumb"},"hash":"9787440297c7aa5118d60fec4929b3de67866cc03e74506e601af49598eb5480"}}]`,
 		},
 	}
 
 	//gin.SetMode(gin.TestMode)
-	router := NewRouter()
+	router := NewRouter(s)
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
 			// form file
@@ -78,18 +101,114 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestUploadStream(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 10},
+	})
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("naming", "uuid")
+	for _, file := range []struct {
+		name    string
+		content []byte
+	}{
+		{"first.png", testPNG(4, 4)},
+		{"big.png", append(testPNG(4, 4), bytes.Repeat([]byte{0}, 1<<10)...)},
+		{"text.png", []byte("not an image")},
+		{"second.png", testPNG(5, 5)},
+	} {
+		part, _ := writer.CreateFormFile("images[]", file.name)
+		part.Write(file.content)
+	}
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/storage/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp := performRequest(NewRouter(s), req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var results []UploadResultDTO
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &results))
+	assert.Len(t, results, 4)
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Regexp(t, `^[0-9a-f-]{36}\.png$`, results[0].File.Name)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, results[1].Status)
+	assert.Equal(t, http.StatusUnsupportedMediaType, results[2].Status)
+	assert.Equal(t, http.StatusOK, results[3].Status)
+	assert.Equal(t, "/images/"+results[3].File.Name+"/thumb", results[3].File.Resize)
+	_, err := s.StatVariant(results[3].File.Name, "thumb")
+	assert.Nil(t, err)
+
+	// options after the files come too late
+	body.Reset()
+	writer = multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("images[]", "late.png")
+	part.Write(testPNG(4, 4))
+	writer.WriteField("naming", "blah")
+	writer.Close()
+	req, _ = http.NewRequest("POST", "/storage/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp = performRequest(NewRouter(s), req)
+	status, file := uploadResult(resp)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "late.png", file.Name)
+}
+
 func TestLink(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/wikipedia/commons/d/d9/Test.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG(10, 10))
+		case "/redirect":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="cat.php"`)
+			w.Write(testPNG(10, 10))
+		case "/img":
+			http.Redirect(w, r, "/photos/pic.png?size=large", http.StatusFound)
+		case "/photos/pic.png":
+			w.Write(testPNG(10, 10))
+		case "/bad.png":
+			w.Write(append(append([]byte{}, pngSignature...), "garbage"...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Fetcher: newTestFetcher(t, FetcherOptions{Timeout: time.Second, MaxRedirects: 1, MaxBytes: 1 << 20}),
+	})
+
 	cases := []struct {
 		url  string
+		code int
 		resp string
 	}{
 		{
-			"https://upload.wikimedia.org/wikipedia/commons/d/d9/Test.png",
-			`[{"name":"Test.png","path":"/images/Test.png","resize":"/images/thumb_Test.png"}]`,
+			server.URL + "/wikipedia/commons/d/d9/Test.png",
+			http.StatusOK,
+			`[{"name":"Test.png","path":"/images/Test.png","resize":"/images/Test.png/thumb","variants":{"thumb":"/images/Test.png/thumb"},"hash":"0978cbc552634abe9fe6bc16011f84555e66a5abf074db691b968f85fb148f6a"}]`,
+		},
+		{
+			server.URL + "/redirect",
+			http.StatusBadRequest,
+			`{"type":"about:blank","title":"Bad Request","status":400,"code":"blocked_address","detail":"address is not allowed"}`,
+		},
+		{
+			"file:///etc/passwd",
+			http.StatusBadRequest,
+			`{"type":"about:blank","title":"Bad Request","status":400,"code":"bad_scheme","detail":"only http and https urls are allowed"}`,
+		},
+		{
+			server.URL + "/missing.png",
+			http.StatusBadGateway,
+			`{"type":"about:blank","title":"Bad Gateway","status":502,"code":"fetch","detail":"could not download file: server responded 404 Not Found"}`,
 		},
 	}
 
-	router := NewRouter()
+	router := NewRouter(s)
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
 			data := url.Values{
@@ -98,13 +217,120 @@ func TestLink(t *testing.T) {
 			req, _ := http.NewRequest("POST", "/storage/upload/link", strings.NewReader(data.Encode()))
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			resp := performRequest(router, req)
-			assert.Equal(t, resp.Code, http.StatusOK)
-			assert.Equal(t, tc.resp, resp.Body.String())
+			assert.Equal(t, tc.code, resp.Code)
+			assert.JSONEq(t, tc.resp, resp.Body.String())
 		})
 	}
+
+	// a file whose variants fail is not left behind
+	data := url.Values{"url": {server.URL + "/bad.png"}}
+	req, _ := http.NewRequest("POST", "/storage/upload/link", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := performRequest(router, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	_, err := s.Stat("bad.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	names := []struct {
+		path string
+		name string
+	}{
+		{"/download", "cat.png"},
+		{"/img", "pic.png"},
+	}
+	for i, tc := range names {
+		t.Run(fmt.Sprintf("name %d", i), func(t *testing.T) {
+			data := url.Values{
+				"url": {server.URL + tc.path},
+			}
+			req, _ := http.NewRequest("POST", "/storage/upload/link?collision=overwrite", strings.NewReader(data.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp := performRequest(router, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			var files []FileDTO
+			json2.Unmarshal(resp.Body.Bytes(), &files)
+			assert.Equal(t, tc.name, files[0].Name)
+		})
+	}
+}
+
+func TestLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png", "/b.png":
+			w.Write(testPNG(10, 10))
+		case "/text.png":
+			w.Write([]byte("not an image"))
+		case "/bad.png":
+			w.Write(append(append([]byte{}, pngSignature...), "garbage"...))
+		case "/internal.png":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Fetcher: newTestFetcher(t, FetcherOptions{Timeout: time.Second, MaxRedirects: 1, MaxBytes: 1 << 20, Workers: 2}),
+	})
+
+	jsonData, _ := json2.Marshal([]interface{}{
+		map[string]string{"url": server.URL + "/a.png"},
+		map[string]string{"url": server.URL + "/b.png", "name": "renamed.png"},
+		map[string]string{"url": server.URL + "/text.png"},
+		map[string]string{"url": server.URL + "/internal.png"},
+		map[string]string{"url": "file:///etc/passwd"},
+		map[string]string{"url": server.URL + "/bad.png"},
+	})
+	req, _ := http.NewRequest("POST", "/storage/upload/links", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	resp := performRequest(NewRouter(s), req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var results []LinkResultDTO
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &results))
+	assert.Len(t, results, 6)
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Equal(t, "a.png", results[0].File.Name)
+	assert.Equal(t, http.StatusOK, results[1].Status)
+	assert.Equal(t, "renamed.png", results[1].File.Name)
+	assert.Equal(t, http.StatusUnsupportedMediaType, results[2].Status)
+	assert.Equal(t, "unsupported_type", results[2].Code)
+	assert.Nil(t, results[2].File)
+	assert.Equal(t, http.StatusBadRequest, results[3].Status)
+	assert.Equal(t, "blocked_address", results[3].Code)
+	assert.Equal(t, "address is not allowed", results[3].Error)
+	assert.Equal(t, http.StatusBadRequest, results[4].Status)
+	assert.Equal(t, "bad_scheme", results[4].Code)
+	assert.Equal(t, "only http and https urls are allowed", results[4].Error)
+	assert.Equal(t, server.URL+"/internal.png", results[3].URL)
+	// a file whose variants fail is not left behind
+	assert.Equal(t, http.StatusUnprocessableEntity, results[5].Status)
+	assert.Equal(t, "bad_image", results[5].Code)
+	_, err := s.Stat("bad.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	req, _ = http.NewRequest("POST", "/storage/upload/links", strings.NewReader(`{"url":"x.png"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp = performRequest(NewRouter(s), req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// more urls than allowed are turned away before anything is fetched
+	many := make([]map[string]string, DefaultFetcherOptions.MaxURLs+1)
+	for i := range many {
+		many[i] = map[string]string{"url": server.URL + "/a.png"}
+	}
+	jsonData, _ = json2.Marshal(many)
+	req, _ = http.NewRequest("POST", "/storage/upload/links", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	resp = performRequest(NewRouter(s), req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"code":"too_many_urls"`)
 }
 
 func TestJson(t *testing.T) {
+	s := newTestService()
 	cases := []struct {
 		Name    string `json:"name"`
 		Ext     string `json:"type"`
@@ -117,11 +343,11 @@ func TestJson(t *testing.T) {
 			Size:    4862,
 			Ext:     "image/png",
 			Content: "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAOEAAADhCAMAAAAJbSJIAAAAkFBMVEX/AAD/////9/f/+vr/fX3/4+P/1NT/9fX/paX//Pz/3t7/jIz/6Oj/7Oz/sbH/z8//KSn/NTX/29v/urr/nJz/wsL/FBT/8PD/kJD/x8f/Tk7/YmL/l5f/Xl7/PT3/eHj/QkL/LCz/Hh7/SEj/goL/Vlb/rq7/aWn/trb/GRn/UlL/cHD/oaH/W1v/Dg7/gYGccI8YAAAIY0lEQVR4nO2dh3qqMBSACchWcICCq646WqXv/3YXpL0KJBAgMSTt/wDt+b9Ixsk4EqCOqciyrKvu5Oh5gR2z9AzH1/q6LCuKSf3fSzT/uD5QrdA4LNaRBOWyXnwZrqUOdIpBUDPsa6Fj34ZwtSzD94MTaiql5qRiOAgd7zTCkXswWiydcEAhGPKGqmOf1vXsflifbGNMOh7ChpZ3mu+a6aVcNiePrCRJQ9143yL6lDpE2w9jRi4qYoby5L293IMPXyEUGBnD2Tgg0HhZdssxkZYkYGiqkzfSeneiN1/tgqF2JfrzzLI6WqwNteWcnl/C7dqya21nqNl7un4x0XzZZ2U4s2vOW5o6bq4tZnQtDI3LS/zu7CYvN9T9hjOzpry78isNFY3O+FDG1B43+q02MlS913yAOfZGk7VHE8PJgoVfwqf7CsNZsGUlGK+vvNozudqGGrMGvBOdNLqG5pFhA6YMj/U6nHqG6uu7UAiftebjdQzNkP4cDYuRW6MZaxjKxylrtR92Dn7+Ed+wv2Tt9cR0iT00YhtanfgE/zPt4X6MuIaMBwkIC8y1Maah1pE+5pk9XiviGYatcqC0uGAN/liGfmc60SxTHEUcQ594ppAUo5CEoTlhPlFDs/Yrx/5KQ3PCZC2Iy8ZvbdhtwaQVWxqGHReUpG3FqrjCsJvDRJaKHrXc0OVAMF4Vl85uSg2tzv9EUzZlif8yQ3XFOnRcbiWKJYaDbq0mSilZ9qMNdbuzU5ki0QGZg0Mamq/clmhPdEXtiiMNfazDPh0CtXeDMtRevPHSHtSwiDAcdG5JX80enp1CGNqsw21CUMNwwjrYRkyhk3CoocXdR5jyARsVYYbKJ+tQm2JD1sMwQ6OjaZlqdmcsQ5fT32jCvDhBLRrOOJqOFgkKQ0bB0OzO/ksTdoXsW8HQonyKizan/BQ8bygHrENsy7HCUONoyQRnOCs35Pw3mtArNTyzDo8E4xJDpcMJfHxOJYYG6+CIMAyRhv0N6+DI8CajDD3uO9KUkY8w7N9Yh0aKng435HdNkWfoQw1VDnMzKGwdZugI8hUmDF2I4azHOiySeErR0OUtBVzKqF8wVDzWQZHFKRgONqxjIsvGzBv6rEMijZszNCleQGPDImeosg6IPErWkPvkRREna8jJmYQ6rDKGAv5Ipa31bNilM9ykiLxnQwESUEVOT4ZjIfIzeTbaw1DAnjRmajwMT6yDocPhv6Eq5GcYjxfqj+FZqIXTg3syQxJ1rLhjfBvKXO+JltGbpYaaoJ+hJO3HqeFZmCxinshNDcXYrYAyuRvqXB7xwiOQE0N+DjvX5zZIDDUB14Y/7NTEMGQdBk3GiSGfBxExmcSG/J8vKSMwJS6PA+OzUCTQ5/igXjUjWQIqV7cOahMbWqxjoMtMAhrrGOjiSmIPFpLkSKawy9+UpWRye2wdj4OkCHOIBk5PUjr44gVJepIs9IB/NxQ0k/hDbChskiYlNmQdAmX+DPnnz5B//gz558+Qf36FofizNoF3LRJ+w/pQETrlnRiawh5TSIkNhd6YkSRPEnkXP8GXxDukn0WVwJh1DHTRJaAKdKELgvwb9g/F3gNeKZLQB4bSfXzzyDoKmoTCn6exEkOxrlZm2d7PRFnCXVt7sLqfa9MPrOOgh62Lfr70LPoZ4bgrvRu6G9aB0GJupYYDQa/MSNJB/75vIeys5vhzo8Th4tnu+mz/35mxBM233azfc3cNkK/m2wXSa7KpoSbk1PT5DikQ8kN8vgcs5HiRvcst4kHh7H18Ed9U+Mi+GnFlHQ95llnDAet4yDPIGprCXWD7/pEK/MZQmDcU7Z2okZI3NAXLZVxB3lCwi5YXq2goCzWvebx++fRuInd1V8p4PH75ZMj3c/NZTn2YoUDJjOipRsKz4UyYpf5ChRuCsyCNeDEAwlAW5A7UrY8yFGTqtnMA0lCMbMZNKTF0WUdHgmzZznxtBAG60zdQamhxP7GZDsoNTe7TGR4oN+T+tZrVoMqQ82F/V6i9Bqn3xPXL5Rj1nn5BzS4ArtyeXLjkSyEhDPmtndeDlLGE1z/kNGWzhxU+htew5LMoUgSpDYisQ8plf3qAqiAMVQ4XGWt4WWdUPWCfv/7UhZugDPk7OVy3pjN3x7+XMkIEXVu9z1X6tJefcGMYgjFHeamThdQoMQTahnXguMwRVcerDIHGSYc6KhEsN+TlokKZYIUhHwnUQoHcOoZg0vnM1LBcsNLQdDpeGGIELRlfwxAox0634ugMKadezxAoTocVR2elKv5qQ2B29+3IoV/VgliGHX5LuaKTwTcEfjdPSSPWS00MO5lhXMOyMo0NgfvBWijPe+lMpr4h0Lq17xZ94rVgDUOgfrG2eiKy1eqI6xqCWXfqeEYGPOvU0hAoXakptMMYBhsZxh9jJ64Mr9AL+taGQA+Yv+A+NConam0M48Gf7bARLbCG+TaGoH9guEk8WuJ3MY0N4yUjs7dCFlWLQTKG8dDoMdl+21yxB8G2hkB2GWyiHrQaY0Rbw7hTffXYuA9RaXtKhvH4/8qLp1OjUfu1M4x71d5r2jFaF8+QvMYQgPDtBV3OPmjSwRAyBIp/oJxtnC9xl0l0DONu1Q8otuPNaOlHwDB21I6UJuSfk1a/T2KG8Sxn4FLYTv3Sas/QYBAxTJgtiXasm3PD4a8AMcMYNZgPSYyRw7mH3LOuD0nDGC1YrVttq142p6Du+qgcwobxN+ka9qlh77pd2QZmjhAf4oYJ/dAJ3mt+lttFcPQJdJ0FqBjGyJYbOvYNa7F82b8dQ02tl5zAhpbhHX2gjn3jsEL+aHfzN8O11P6s8by6GqqGKaYiy3pfCydHL/jq9ewEzwnHM1mWFYpq3/wDy8x54GS8+O4AAAAASUVORK5CYII=",
-			resp:    `[{"name":"test.png","path":"/images/test.png","resize":"/images/thumb_test.png"}]`,
+			resp:    `[{"name":"test.png","status":200,"file":{"name":"test.png","path":"/images/test.png","resize":"/images/test.png/thumb","variants":{"thumb":"/images/test.png/thumb"},"hash":"9787440297c7aa5118d60fec4929b3de67866cc03e74506e601af49598eb5480"}}]`,
 		},
 	}
 
-	router := NewRouter()
+	router := NewRouter(s)
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
 			var data []interface{}
@@ -146,5 +372,376 @@ func TestErrorResponse(t *testing.T) {
 	resp := rec.Result()
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 	b, _ := ioutil.ReadAll(resp.Body)
-	assert.JSONEq(t, string(b), `{"message":"test"}`)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Bad Request","status":400,"code":"bad_request","detail":"test"}`, string(b))
+}
+
+func TestDownload(t *testing.T) {
+	s := newTestService()
+	content, _ := base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGP4z8DwHwAFAAH/iZk9HQAAAABJRU5ErkJggg==")
+	_, err := s.SaveFile(File{
+		Name:    "download.png",
+		Type:    "image/png",
+		Content: bytes.NewReader(content),
+		Size:    len(content),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, s.saveDerivative("download.png", "thumb", "image/png", content))
+
+	cases := []struct {
+		url  string
+		code int
+		mime string
+	}{
+		{"/storage/images/download.png", http.StatusOK, "image/png"},
+		{"/storage/images/missing.png", http.StatusNotFound, ""},
+		{"/storage/images/..", http.StatusNotFound, ""},
+		{"/storage/images/download.png/thumb", http.StatusOK, "image/png"},
+		{"/storage/images/download.png/medium", http.StatusNotFound, ""},
+		{"/storage/images/missing.png/thumb", http.StatusNotFound, ""},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.url, nil)
+			resp := performRequest(router, req)
+			assert.Equal(t, tc.code, resp.Code)
+			if tc.code != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tc.mime, resp.Header().Get("Content-Type"))
+			assert.Equal(t, fmt.Sprint(len(content)), resp.Header().Get("Content-Length"))
+			assert.NotEmpty(t, resp.Header().Get("Last-Modified"))
+			assert.NotEmpty(t, resp.Header().Get("ETag"))
+			assert.Equal(t, content, resp.Body.Bytes())
+		})
+	}
+}
+
+func TestDownloadConditional(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+
+	content := testPNG(16, 16)
+	info, err := s.Save(File{
+		Name:    "cached.png",
+		Type:    "image/png",
+		Content: bytes.NewReader(content),
+		Size:    len(content),
+	})
+	assert.Nil(t, err)
+	tag := `"` + info.Hash + `"`
+	modified := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	size := fmt.Sprint(len(content))
+
+	cases := []struct {
+		method  string
+		url     string
+		headers map[string]string
+		code    int
+		length  string
+		body    []byte
+	}{
+		{"GET", "/storage/images/cached.png", nil, http.StatusOK, size, content},
+		{"HEAD", "/storage/images/cached.png", nil, http.StatusOK, size, nil},
+		{"HEAD", "/storage/images/missing.png", nil, http.StatusNotFound, "", nil},
+		{"GET", "/storage/images/cached.png", map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, "10", content[:10]},
+		{"GET", "/storage/images/cached.png", map[string]string{"Range": "bytes=-4"}, http.StatusPartialContent, "4", content[len(content)-4:]},
+		{"GET", "/storage/images/cached.png", map[string]string{"Range": "bytes=100000-"}, http.StatusRequestedRangeNotSatisfiable, "", nil},
+		{"GET", "/storage/images/cached.png", map[string]string{"If-None-Match": tag}, http.StatusNotModified, "", nil},
+		{"GET", "/storage/images/cached.png", map[string]string{"If-None-Match": `"other", ` + tag}, http.StatusNotModified, "", nil},
+		{"GET", "/storage/images/cached.png", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, size, content},
+		{"HEAD", "/storage/images/cached.png", map[string]string{"If-None-Match": tag}, http.StatusNotModified, "", nil},
+		{"GET", "/storage/images/cached.png", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified, "", nil},
+		// If-None-Match wins over If-Modified-Since
+		{"GET", "/storage/images/cached.png", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modified}, http.StatusOK, size, content},
+		{"GET", "/storage/images/cached.png", map[string]string{"Range": "bytes=0-9", "If-Range": tag}, http.StatusPartialContent, "10", content[:10]},
+		{"GET", "/storage/images/cached.png", map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`}, http.StatusOK, size, content},
+		{"GET", "/storage/images/cached.png", map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed, "", nil},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, tc.url, nil)
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			resp := performRequest(router, req)
+			assert.Equal(t, tc.code, resp.Code)
+			if tc.length != "" {
+				assert.Equal(t, tc.length, resp.Header().Get("Content-Length"))
+			}
+			if tc.code == http.StatusNotFound || tc.code == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			assert.Equal(t, tc.body, resp.Body.Bytes())
+			assert.Equal(t, tag, resp.Header().Get("ETag"))
+		})
+	}
+
+	// renderings have their own tag
+	req, _ := http.NewRequest("GET", "/storage/images/cached.png?w=64", nil)
+	resp := performRequest(router, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	rendered := resp.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, rendered)
+	assert.NotEqual(t, tag, rendered)
+	req.Header.Set("If-None-Match", rendered)
+	resp = performRequest(router, req)
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+}
+
+func TestRemove(t *testing.T) {
+	s := newTestService()
+	_, err := s.SaveFile(File{
+		Name:    "remove.png",
+		Type:    "image/png",
+		Content: strings.NewReader("123"),
+		Size:    3,
+	})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		url  string
+		code int
+		resp string
+	}{
+		{"/storage/images/remove.png", http.StatusOK, `{"name":"remove.png","deleted":["/images/remove.png"]}`},
+		{"/storage/images/remove.png", http.StatusNotFound, `{"type":"about:blank","title":"Not Found","status":404,"code":"not_found","detail":"file not found"}`},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			req, _ := http.NewRequest("DELETE", tc.url, nil)
+			resp := performRequest(router, req)
+			assert.Equal(t, tc.code, resp.Code)
+			assert.JSONEq(t, tc.resp, resp.Body.String())
+		})
+	}
+}
+
+func TestJsonCollision(t *testing.T) {
+	s := newTestService()
+	pixel := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGP4z8DwHwAFAAH/iZk9HQAAAABJRU5ErkJggg=="
+	other := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGNgYPj/HwADAgH/5ncLrgAAAABJRU5ErkJggg=="
+	cases := []struct {
+		content string
+		query   string
+		code    int
+		name    string
+	}{
+		{pixel, "", http.StatusOK, "conflict.png"},
+		{pixel, "", http.StatusOK, "conflict.png"},
+		{other, "", http.StatusConflict, ""},
+		{other, "?collision=rename", http.StatusOK, "conflict-1.png"},
+		{other, "?collision=overwrite", http.StatusOK, "conflict.png"},
+		{other, "?collision=blah", http.StatusBadRequest, ""},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			jsonData, _ := json2.Marshal([]interface{}{map[string]interface{}{
+				"name":    "conflict.png",
+				"type":    "image/png",
+				"size":    1,
+				"content": tc.content,
+			}})
+			req, _ := http.NewRequest("POST", "/storage/upload/json"+tc.query, bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			resp := performRequest(router, req)
+			status, file := uploadResult(resp)
+			assert.Equal(t, tc.code, status)
+			assert.Equal(t, tc.name, file.Name)
+		})
+	}
+}
+
+func TestDownloadTransform(t *testing.T) {
+	s := newTestService()
+	content, _ := base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGP4z8DwHwAFAAH/iZk9HQAAAABJRU5ErkJggg==")
+	_, err := s.SaveFile(File{
+		Name:    "transform.png",
+		Type:    "image/png",
+		Content: bytes.NewReader(content),
+		Size:    len(content),
+	})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		url  string
+		code int
+		mime string
+	}{
+		{"/storage/images/transform.png?w=64", http.StatusOK, "image/png"},
+		{"/storage/images/transform.png?w=64&format=jpeg&q=75", http.StatusOK, "image/jpeg"},
+		{"/storage/images/transform.png?w=63", http.StatusBadRequest, ""},
+		{"/storage/images/transform.png?w=abc", http.StatusBadRequest, ""},
+		{"/storage/images/missing.png?w=64", http.StatusNotFound, ""},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.url, nil)
+			resp := performRequest(router, req)
+			assert.Equal(t, tc.code, resp.Code)
+			if tc.code == http.StatusOK {
+				assert.Equal(t, tc.mime, resp.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestJsonConvert(t *testing.T) {
+	s := newTestService()
+	pixel := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGP4z8DwHwAFAAH/iZk9HQAAAABJRU5ErkJggg=="
+	cases := []struct {
+		query  string
+		code   int
+		name   string
+		source string
+		thumb  string
+	}{
+		{"?format=jpeg&quality=80", http.StatusOK, "convert.jpg", "", "/images/convert.jpg/thumb"},
+		{"?format=image/jpeg&keep_source=true&collision=overwrite", http.StatusOK, "convert.jpg", "/images/convert.jpg/source.png", "/images/convert.jpg/thumb"},
+		{"?format=png", http.StatusOK, "convert.png", "", "/images/convert.png/thumb"},
+		{"?format=webp", http.StatusBadRequest, "", "", ""},
+		{"?format=svg", http.StatusBadRequest, "", "", ""},
+		{"?format=jpeg&quality=101", http.StatusBadRequest, "", "", ""},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			jsonData, _ := json2.Marshal([]interface{}{map[string]interface{}{
+				"name":    "convert.png",
+				"type":    "image/png",
+				"size":    1,
+				"content": pixel,
+			}})
+			req, _ := http.NewRequest("POST", "/storage/upload/json"+tc.query, bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			resp := performRequest(router, req)
+			status, file := uploadResult(resp)
+			assert.Equal(t, tc.code, status)
+			assert.Equal(t, tc.name, file.Name)
+			assert.Equal(t, tc.source, file.Source)
+			assert.Equal(t, tc.thumb, file.Resize)
+			if tc.source != "" {
+				req, _ := http.NewRequest("GET", "/storage"+tc.source, nil)
+				resp := performRequest(router, req)
+				assert.Equal(t, http.StatusOK, resp.Code)
+				assert.Equal(t, "image/png", resp.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestJsonBatch(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+
+	item := func(name string, content []byte) map[string]interface{} {
+		return map[string]interface{}{
+			"name":    name,
+			"type":    "image/png",
+			"size":    len(content),
+			"content": base64.StdEncoding.EncodeToString(content),
+		}
+	}
+	post := func(query string, items ...interface{}) *httptest.ResponseRecorder {
+		jsonData, _ := json2.Marshal(items)
+		req, _ := http.NewRequest("POST", "/storage/upload/json"+query, bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		return performRequest(NewRouter(s), req)
+	}
+	statuses := func(results []UploadResultDTO) []int {
+		var codes []int
+		for _, r := range results {
+			codes = append(codes, r.Status)
+		}
+		return codes
+	}
+
+	// without atomic the good files are kept
+	resp := post("", item("first.png", testPNG(2, 2)), item("bad.png", []byte("not an image")), item("second.png", testPNG(3, 3)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var results []UploadResultDTO
+	json2.Unmarshal(resp.Body.Bytes(), &results)
+	assert.Equal(t, []int{http.StatusOK, http.StatusUnprocessableEntity, http.StatusOK}, statuses(results))
+	assert.Equal(t, "bad.png", results[1].Name)
+	assert.Equal(t, "bad_image", results[1].Code)
+	assert.NotEmpty(t, results[1].Error)
+	_, err := s.Stat("second.png")
+	assert.Nil(t, err)
+
+	// an atomic batch is rolled back, but files that were there stay
+	resp = post("?atomic=true", item("first.png", testPNG(2, 2)), item("third.png", testPNG(4, 4)), item("second.png", testPNG(5, 5)), item("fourth.png", testPNG(6, 6)))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	var failed struct {
+		Code    string            `json:"code"`
+		Detail  string            `json:"detail"`
+		Results []UploadResultDTO `json:"results"`
+	}
+	json2.Unmarshal(resp.Body.Bytes(), &failed)
+	assert.Equal(t, "exists", failed.Code)
+	assert.Equal(t, "no files saved, second.png: file already exists, set collision to overwrite or rename", failed.Detail)
+	assert.Equal(t, []int{http.StatusOK, http.StatusFailedDependency, http.StatusConflict, http.StatusFailedDependency}, statuses(failed.Results))
+	_, err = s.Stat("first.png")
+	assert.Nil(t, err)
+	_, err = s.Stat("third.png")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.StatVariant("third.png", "thumb")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Stat("fourth.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	resp = post("?atomic=true", item("third.png", testPNG(4, 4)), item("fourth.png", testPNG(6, 6)))
+	json2.Unmarshal(resp.Body.Bytes(), &results)
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, statuses(results))
+
+	assert.Equal(t, http.StatusBadRequest, post("?atomic=true&collision=overwrite", item("first.png", testPNG(2, 2))).Code)
+	assert.Equal(t, http.StatusBadRequest, post("?atomic=maybe", item("first.png", testPNG(2, 2))).Code)
+}
+
+func TestJsonLimits(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 10},
+	})
+
+	cases := []struct {
+		content []byte
+		code    int
+	}{
+		{testPNG(10, 10), http.StatusOK},
+		{testBomb(50000, 50000), http.StatusUnprocessableEntity},
+		{bytes.Repeat([]byte{0}, 1<<10+1), http.StatusRequestEntityTooLarge},
+	}
+
+	router := NewRouter(s)
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			jsonData, _ := json2.Marshal([]interface{}{map[string]interface{}{
+				"name":    fmt.Sprintf("limits%d.png", i),
+				"type":    "image/png",
+				"size":    len(tc.content),
+				"content": base64.StdEncoding.EncodeToString(tc.content),
+			}})
+			req, _ := http.NewRequest("POST", "/storage/upload/json", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+			resp := performRequest(router, req)
+			status, _ := uploadResult(resp)
+			assert.Equal(t, tc.code, status)
+		})
+	}
+
+	// the body is cut off before it is all in memory
+	body := `[{"name": "big.png", "type": "image/png", "size": 1, "content": "` + strings.Repeat("A", 1<<20) + `"}]`
+	req, _ := http.NewRequest("POST", "/storage/upload/json", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := performRequest(router, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"code":"too_large"`)
 }
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cutOffWait is how long uploads cut off at the end of a shutdown get to
+// fail and remove what they wrote.
+const cutOffWait = 5 * time.Second
+
+// expirySweep is how often expired uploads are looked for.
+const expirySweep = 10 * time.Minute
+
+var ErrShuttingDown = newError(http.StatusServiceUnavailable, "shutting_down", "server is shutting down, try again later")
+
+// drain tracks the uploads in flight and the temporary objects they
+// write. Once closed it turns new uploads away, wait blocks until the
+// running ones are done.
+type drain struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+	temps  map[string]bool
+}
+
+func newDrain() *drain {
+	return &drain{temps: map[string]bool{}}
+}
+
+func (d *drain) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.wg.Add(1)
+	return true
+}
+
+func (d *drain) leave() {
+	d.wg.Done()
+}
+
+func (d *drain) close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+}
+
+func (d *drain) writing(key string) {
+	d.mu.Lock()
+	d.temps[key] = true
+	d.mu.Unlock()
+}
+
+func (d *drain) written(key string) {
+	d.mu.Lock()
+	delete(d.temps, key)
+	d.mu.Unlock()
+}
+
+// unfinished are the temporary objects still being written.
+func (d *drain) unfinished() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]string, 0, len(d.temps))
+	for key := range d.temps {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (d *drain) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// accepting guards the upload routes, they are answered with 503 once the
+// server shuts down.
+func (h handlers) accepting(c *gin.Context) {
+	if !h.service.drain.enter() {
+		c.Header("Retry-After", "30")
+		c.Header("Connection", "close")
+		problemResponse(c, ErrShuttingDown, nil)
+		c.Abort()
+		return
+	}
+	defer h.service.drain.leave()
+	c.Next()
+}
+
+// removeUnfinished removes the temporary objects of uploads that were cut
+// off. Other instances sharing the backend keep theirs.
+func (s service) removeUnfinished() error {
+	for _, key := range s.drain.unfinished() {
+		if err := s.backend.Delete(key); err != nil && err != ErrNotFound {
+			return err
+		}
+		s.drain.written(key)
+	}
+	return nil
+}
+
+// removeExpired removes the unfinished uploads that expired before now.
+func (s service) removeExpired(now time.Time) error {
+	if err := s.tus.removeExpired(now); err != nil {
+		return err
+	}
+	return s.sessions.removeExpired(now)
+}
+
+// Server serves the API of a service over HTTP.
+type Server struct {
+	server  *http.Server
+	service *service
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+func NewServer(addr string, s *service) *Server {
+	return &Server{
+		server:  &http.Server{Addr: addr, Handler: NewRouter(s)},
+		service: s,
+		stop:    make(chan struct{}),
+	}
+}
+
+// ListenAndServe serves until Shutdown, which is not an error.
+func (s *Server) ListenAndServe() error {
+	go s.sweep()
+	return serveError(s.server.ListenAndServe())
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	go s.sweep()
+	return serveError(s.server.Serve(l))
+}
+
+// sweep removes expired uploads every expirySweep until Shutdown.
+func (s *Server) sweep() {
+	ticker := time.NewTicker(expirySweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.service.removeExpired(now); err != nil {
+				log.Printf("error: %v\n", err)
+			}
+		}
+	}
+}
+
+func serveError(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops taking new uploads and waits until ctx is done for the
+// requests in flight. Requests still running then are cut off and the
+// temporary objects of their uploads removed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopped.Do(func() { close(s.stop) })
+	s.service.drain.close()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+		wait, cancel := context.WithTimeout(context.Background(), cutOffWait)
+		s.service.drain.wait(wait)
+		cancel()
+	}
+	if rerr := s.service.removeUnfinished(); err == nil {
+		err = rerr
+	}
+	return err
+}
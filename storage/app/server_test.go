@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUpload posts a file of which all but the last bytes are sent until
+// finish is closed. The response arrives on the returned channel.
+func startUpload(url string, content []byte, finish chan struct{}) chan *http.Response {
+	r, w := io.Pipe()
+	writer := multipart.NewWriter(w)
+	go func() {
+		part, _ := writer.CreateFormFile("images[]", "inflight.png")
+		part.Write(content[:len(content)-100])
+		<-finish
+		part.Write(content[len(content)-100:])
+		writer.Close()
+		w.Close()
+	}()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(url+"/storage/upload", writer.FormDataContentType(), r)
+		if err != nil {
+			r.CloseWithError(err)
+		}
+		responses <- resp
+	}()
+	return responses
+}
+
+// temps counts the temporary files of the fs backend and the temporary
+// objects uploads are writing.
+func temps(fs afero.Fs, s *service) int {
+	infos, _ := afero.ReadDir(fs, "/images/"+fsTempDir)
+	return len(infos) + len(s.drain.unfinished())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func closed(d *drain) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+func TestShutdown(t *testing.T) {
+	// trailing bytes after the image end are ignored by decoders
+	content := append(testPNG(64, 64), make([]byte, 4096)...)
+	cases := []struct {
+		finish  bool
+		timeout time.Duration
+		err     error
+		saved   bool
+	}{
+		{true, 5 * time.Second, nil, true},
+		{false, 100 * time.Millisecond, context.DeadlineExceeded, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			s := NewService(NewFsBackend(fs, "/images"), Options{})
+			server := NewServer("", s)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err)
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(l) }()
+
+			finish := make(chan struct{})
+			responses := startUpload("http://"+l.Addr().String(), content, finish)
+			waitFor(t, "the upload to start", func() bool { return temps(fs, s) == 2 })
+
+			shutdown := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+				defer cancel()
+				shutdown <- server.Shutdown(ctx)
+			}()
+			waitFor(t, "the shutdown to start", func() bool { return closed(s.drain) })
+			assert.Nil(t, <-served)
+
+			// new uploads are turned away, the rest of the API still works
+			req, _ := http.NewRequest("POST", "/storage/upload/json", strings.NewReader("[]"))
+			resp := performRequest(NewRouter(s), req)
+			assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+			assert.Equal(t, "30", resp.Header().Get("Retry-After"))
+			assert.Contains(t, resp.Body.String(), `"code":"shutting_down"`)
+			req, _ = http.NewRequest("GET", "/storage/ping", nil)
+			resp = performRequest(NewRouter(s), req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+
+			if tc.finish {
+				close(finish)
+			}
+			assert.Equal(t, tc.err, <-shutdown)
+			if !tc.finish {
+				// the rest goes to the closed connection
+				close(finish)
+			}
+			if uploaded := <-responses; uploaded != nil {
+				assert.Equal(t, tc.saved, uploaded.StatusCode == http.StatusOK)
+				uploaded.Body.Close()
+			}
+
+			_, err = s.Stat("inflight.png")
+			assert.Equal(t, tc.saved, err == nil)
+			assert.Equal(t, 0, temps(fs, s))
+		})
+	}
+}
@@ -2,99 +2,656 @@ package app
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"github.com/nfnt/resize"
 	"github.com/spf13/afero"
 	"image"
-	_ "image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
-	"os"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
 )
 
-var Service *service
+const maxRenames = 1000
 
-func init() {
-	if len(os.Getenv("TESTING")) > 0 {
-		Service = NewService(afero.NewMemMapFs())
-	} else {
-		Service = NewService(afero.NewOsFs())
-	}
+// DefaultUploadExpiry is how long unfinished uploads are kept by default.
+const DefaultUploadExpiry = 24 * time.Hour
+
+type Options struct {
+	// Variants are the thumbnails made for every upload, DefaultVariants
+	// when empty
+	Variants []Variant
+	// TransformSizes and TransformQualities allow-list the parameters of on
+	// the fly transforms, variant sizes are always allowed
+	TransformSizes     []uint
+	TransformQualities []int
+	// NormalizeOrientation rotates JPEG, PNG and TIFF originals upright on
+	// upload instead of keeping the EXIF orientation, uploads may override
+	// it
+	NormalizeOrientation bool
+	// StripMetadata removes EXIF, XMP, IPTC and text metadata from
+	// originals on upload, uploads may override it
+	StripMetadata bool
+	// Format converts uploads and their variants to this type. Quality is
+	// the encoding quality of converted uploads and of variants without
+	// their own. KeepSource stores the unconverted original as the
+	// "source" derivative.
+	Format     string
+	Quality    int
+	KeepSource bool
+	// Limits bound the size of accepted images, DefaultLimits when zero
+	Limits Limits
+	// Fetcher downloads linked files, one with DefaultFetcherOptions and
+	// the byte limit of Limits when nil
+	Fetcher *Fetcher
+	// Uploads keeps unfinished resumable uploads and upload sessions, in
+	// memory when nil
+	Uploads afero.Fs
+	// UploadExpiry is how long unfinished uploads are kept,
+	// DefaultUploadExpiry when zero
+	UploadExpiry time.Duration
+	// PublicPath is the URL path files are served under, /images when
+	// empty
+	PublicPath string
 }
 
 type service struct {
-	fs afero.Fs
+	backend              Backend
+	variants             []Variant
+	transformSizes       []uint
+	transformQualities   []int
+	normalizeOrientation bool
+	stripMetadata        bool
+	format               string
+	targetQuality        int
+	keepSource           bool
+	limits               Limits
+	fetcher              *Fetcher
+	names                *stripedLocks
+	hashes               *stripedLocks
+	tus                  *tusStore
+	sessions             *sessionStore
+	publicPath           string
+	drain                *drain
 }
 
-func NewService(fs afero.Fs) *service {
-	return &service{
-		fs: fs,
+func NewService(backend Backend, options Options) *service {
+	s := &service{
+		backend:              storageBackend{backend},
+		variants:             options.Variants,
+		transformSizes:       options.TransformSizes,
+		transformQualities:   options.TransformQualities,
+		normalizeOrientation: options.NormalizeOrientation,
+		stripMetadata:        options.StripMetadata,
+		format:               canonicalMimeType(options.Format),
+		targetQuality:        options.Quality,
+		keepSource:           options.KeepSource,
+		limits:               options.Limits,
+		fetcher:              options.Fetcher,
+		names:                &stripedLocks{},
+		hashes:               &stripedLocks{},
+		publicPath:           strings.TrimSuffix(options.PublicPath, "/"),
+		drain:                newDrain(),
+	}
+	if s.publicPath == "" {
+		s.publicPath = "/images"
+	}
+	if options.Uploads == nil {
+		options.Uploads = afero.NewMemMapFs()
+	}
+	if options.UploadExpiry == 0 {
+		options.UploadExpiry = DefaultUploadExpiry
+	}
+	s.tus = newTusStore(options.Uploads, options.UploadExpiry)
+	s.sessions = newSessionStore(options.Uploads, options.UploadExpiry)
+	if len(s.variants) == 0 {
+		s.variants = DefaultVariants
 	}
+	if len(s.transformSizes) == 0 {
+		s.transformSizes = DefaultTransformSizes
+	}
+	if len(s.transformQualities) == 0 {
+		s.transformQualities = DefaultTransformQualities
+	}
+	if s.limits == (Limits{}) {
+		s.limits = DefaultLimits
+	}
+	if s.fetcher == nil {
+		options := DefaultFetcherOptions
+		options.MaxBytes = s.limits.MaxBytes
+		// the default options have no networks to parse
+		s.fetcher, _ = NewFetcher(options)
+	}
+	return s
 }
 
 func (s service) SaveFile(file File) (string, error) {
+	info, err := s.Save(file)
+	if err != nil {
+		return "", err
+	}
+	return s.path(info.Name), nil
+}
+
+func (s service) Save(file File) (FileInfo, error) {
+	if !checkMimeType(file.Type) {
+		return FileInfo{}, ErrUnsupportedType
+	}
+	b, err := s.limits.readAll(file.Content)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := s.limits.check(b); err != nil {
+		return FileInfo{}, err
+	}
+
+	p, err := s.prepare(file, b)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	hash := contentHash(p.content)
+	return s.commit(p, hash, int64(len(p.content)), func() error {
+		return s.putBlob(hash, p.content)
+	})
+}
+
+// SaveStream stores an upload like Save without holding it in memory: the
+// content is hashed on its way to a temporary object, checked there and
+// then becomes the blob. Uploads processed on save, by metadata stripping,
+// orientation or conversion, are read in full and go through Save, which
+// holds the content and its processed copy in memory.
+func (s service) SaveStream(file File) (FileInfo, error) {
 	if !checkMimeType(file.Type) {
-		return "", errors.New("wrong mime type")
+		return FileInfo{}, ErrUnsupportedType
+	}
+	if strip, normalize, target := s.processing(file); strip || normalize || target != "" {
+		return s.Save(file)
 	}
 
-	path := getSavePath(file.Name)
+	key, hash, size, err := s.putTemp(s.limits.reader(file.Content))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer s.dropTemp(key)
+	obj, err := s.backend.Get(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	err = s.limits.checkConfig(obj)
+	obj.Close()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return s.commit(prepared{File: file}, hash, size, func() error {
+		return s.promote(key, hash)
+	})
+}
 
-	to, err := s.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+// commit gives the content its name, following the naming and collision
+// options. put stores the blob of hash, it runs only once a name was
+// claimed.
+func (s service) commit(p prepared, hash string, size int64, put func() error) (FileInfo, error) {
+	file := p.File
+	r := ref{Hash: hash, Type: canonicalMimeType(file.Type), Size: size}
+	name := nameFor(file.Name, file.Type, file.Naming)
+	base := name
+	old, err := s.claim(fileRef(name), file.Collision, r, put)
+	for n := 1; err == ErrExists && file.Collision == CollisionRename && n <= maxRenames; n++ {
+		if file.Naming == NamingUUID || file.Naming == NamingULID {
+			name = nameFor(file.Name, file.Type, file.Naming)
+		} else {
+			name = renamed(base, n)
+		}
+		old, err = s.claim(fileRef(name), file.Collision, r, put)
+	}
 	if err != nil {
-		return "", err
+		return FileInfo{}, err
 	}
-	_, err = io.Copy(to, file.Content)
+	if old.Hash != "" && old.Hash != hash {
+		if err := s.purgeCache(name); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	info, err := s.Stat(name)
 	if err != nil {
+		return FileInfo{}, err
+	}
+	info.Created = old.Hash == ""
+	info.Stripped = p.stripped
+	if p.source != nil {
+		if info.Source, err = s.saveSource(name, p.sourceType, p.source); err != nil {
+			return FileInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// claim links rn to the blob of r under the lock of its key, so saves and
+// deletes of one name take turns. A name linked to other content is
+// ErrExists unless collision is overwrite. old is the ref it replaced,
+// empty when the name is new.
+func (s service) claim(rn refName, collision Collision, r ref, put func() error) (old ref, err error) {
+	defer s.names.lock(rn.key)()
+	old, err = s.readRef(rn)
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		return ref{}, err
+	case old.Hash == r.Hash:
+		// same content under the same name is not a collision
+		return old, nil
+	case collision != CollisionOverwrite:
+		return ref{}, ErrExists
+	}
+
+	if err := s.linkBlob(rn, r, put); err != nil {
+		return ref{}, err
+	}
+	if old.Hash == "" {
+		return ref{}, nil
+	}
+	return old, s.release(old.Hash, rn.link)
+}
+
+// prepared is an upload after the metadata and format options were
+// applied, with its content when it was read. source holds the original
+// content when it is kept next to a converted file.
+type prepared struct {
+	File
+	content    []byte
+	source     []byte
+	sourceType string
+	stripped   []string
+}
+
+// prepare applies the metadata and format options to b, the content of
+// file.
+func (s service) prepare(file File, b []byte) (prepared, error) {
+	strip, normalize, target := s.processing(file)
+	if !strip && !normalize && target == "" {
+		return prepared{File: file, content: b}, nil
+	}
+	var err error
+	var stripped []string
+	if normalize {
+		b, stripped, err = normalizeOrientation(file.Type, b)
+		if err != nil {
+			return prepared{}, ErrBadImage.wrap(err)
+		}
+	}
+	if strip {
+		var removed []string
+		b, removed, err = stripMetadata(file.Type, b)
+		if err != nil {
+			return prepared{}, ErrBadImage.wrap(fmt.Errorf("could not strip metadata: %s", err.Error()))
+		}
+		stripped = mergeKinds(stripped, removed)
+	}
+	p := prepared{File: file, content: b, stripped: stripped}
+	if target == "" {
+		return p, nil
+	}
+
+	if boolOr(file.KeepSource, s.keepSource) {
+		p.source, p.sourceType = b, file.Type
+	}
+	img, err := decodeImage(bytes.NewReader(b))
+	if err != nil {
+		return prepared{}, err
+	}
+	quality := file.Quality
+	if quality == 0 {
+		quality = s.targetQuality
+	}
+	var buff bytes.Buffer
+	if err := encodeImage(&buff, img, target, quality); err != nil {
+		return prepared{}, err
+	}
+	p.Type = target
+	p.content = buff.Bytes()
+	p.Size = buff.Len()
+	p.Name = withExt(file.Name, target)
+	return p, nil
+}
+
+// processing tells which of the metadata and format options apply to file.
+func (s service) processing(file File) (strip, normalize bool, target string) {
+	strip = boolOr(file.Strip, s.stripMetadata)
+	target = s.targetFormat(file)
+	normalize = boolOr(file.Normalize, s.normalizeOrientation) && target == "" && normalizable(file.Type)
+	return strip, normalize, target
+}
+
+// targetFormat is the type file should be converted to, empty when it is
+// stored as it is.
+func (s service) targetFormat(file File) string {
+	target := file.Format
+	if target == "" {
+		target = s.format
+	}
+	if target == "" || canonicalMimeType(target) == canonicalMimeType(file.Type) {
+		return ""
+	}
+	return canonicalMimeType(target)
+}
+
+// saveSource stores the original of a converted file as its "source"
+// derivative and returns the name it is served under. It was processed
+// before the conversion already.
+func (s service) saveSource(name, mimeType string, b []byte) (string, error) {
+	if err := s.saveDerivative(name, sourceVariant, mimeType, b); err != nil {
 		return "", err
 	}
-	return path, nil
+	return sourceName(name, mimeType), nil
 }
 
-func (s service) Resize(file File) (string, error) {
-	img, _, err := image.Decode(file.Content)
+// sourceName is the name the source of name is served under, with the
+// extension of its own type.
+func sourceName(name, mimeType string) string {
+	return withExt(variantName(sourceVariant, name), mimeType)
+}
+
+// saveDerivative stores b as the variant of name, replacing the one there.
+func (s service) saveDerivative(name, variant, mimeType string, b []byte) error {
+	hash := contentHash(b)
+	r := ref{Hash: hash, Type: canonicalMimeType(mimeType), Size: int64(len(b))}
+	_, err := s.claim(derivativeRef(name, variant), CollisionOverwrite, r, func() error {
+		return s.putBlob(hash, b)
+	})
+	return err
+}
+
+// boolOr is the per upload value when there is one, the default otherwise.
+func boolOr(value *bool, defaultValue bool) bool {
+	if value != nil {
+		return *value
+	}
+	return defaultValue
+}
+
+// Fetch downloads a linked file.
+func (s service) Fetch(url string) (*Fetched, error) {
+	return s.fetcher.Fetch(url)
+}
+
+// CheckURLs fails with ErrTooManyURLs when n urls are too many for one
+// links import.
+func (s service) CheckURLs(n int) error {
+	return s.fetcher.CheckURLs(n)
+}
+
+// FetchAll downloads linked files concurrently, see Fetcher.FetchAll.
+func (s service) FetchAll(urls []string, done func(i int, fetched *Fetched, err error)) {
+	s.fetcher.FetchAll(urls, done)
+}
+
+// ReadContent reads an upload, failing with ErrTooLarge past the byte
+// limit.
+func (s service) ReadContent(r io.Reader) ([]byte, error) {
+	return s.limits.readAll(r)
+}
+
+// MaxBytes is the size limit of uploads, 0 when there is none.
+func (s service) MaxBytes() int64 {
+	return s.limits.MaxBytes
+}
+
+// CheckSize fails with ErrTooLarge when an upload of size bytes would be
+// over the limit.
+func (s service) CheckSize(size int64) error {
+	return s.limits.checkSize(size)
+}
+
+func (s service) Stat(name string) (FileInfo, error) {
+	if !checkName(name) {
+		return FileInfo{}, ErrNotFound
+	}
+	return s.statRef(fileRef(name), name)
+}
+
+// StatVariant describes the variant of name, "source" is the kept source,
+// with or without its extension.
+func (s service) StatVariant(name, variant string) (FileInfo, error) {
+	requested := variant
+	if strings.TrimSuffix(variant, path.Ext(variant)) == sourceVariant {
+		variant = sourceVariant
+	}
+	if !checkName(name) || !s.hasDerivative(variant) {
+		return FileInfo{}, ErrNotFound
+	}
+	info, err := s.statRef(derivativeRef(name, variant), variantName(variant, name))
+	if err != nil || variant != sourceVariant {
+		return info, err
+	}
+	info.Name = sourceName(name, info.Type)
+	if requested != sourceVariant && info.Name != variantName(requested, name) {
+		return FileInfo{}, ErrNotFound
+	}
+	return info, nil
+}
+
+// statRef describes the ref rn, as the file served under name.
+func (s service) statRef(rn refName, name string) (FileInfo, error) {
+	stat, err := s.backend.Stat(rn.key)
 	if err != nil {
+		return FileInfo{}, err
+	}
+	r, err := s.readRef(rn)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Name:     name,
+		Size:     r.Size,
+		Type:     r.Type,
+		Hash:     r.Hash,
+		Modified: stat.Modified,
+	}, nil
+}
+
+// Resize makes every variant of the file and returns the path of the
+// primary one.
+func (s service) Resize(file File) (string, error) {
+	if _, err := s.Variants(file); err != nil {
 		return "", err
 	}
-	thumbnail := resize.Thumbnail(100, 100, img, resize.Lanczos3)
-	var buff bytes.Buffer
-	switch file.Type {
-	case "image/png":
-		png.Encode(&buff, thumbnail)
-		break
-	case "image/jpg", "image/jpeg":
-		jpeg.Encode(&buff, thumbnail, nil)
-		break
-	default:
-		return "", errors.New("could not encode image")
-	}
-	if buff.Len() > 0 {
-		path, err := s.SaveFile(File{
-			Name:    fmt.Sprintf("thumb_%s", file.Name),
-			Type:    file.Type,
-			Content: bytes.NewReader(buff.Bytes()),
-			Size:    buff.Len(),
-		})
+	return s.ThumbnailPath(file.Name), nil
+}
+
+func (s service) Variants(file File) (map[string]string, error) {
+	img, err := s.limits.decode(file.Content)
+	if err != nil {
+		return nil, err
+	}
+	// variants are served under the name of the original even when they
+	// are encoded to another type, the ref records the real one
+	mimeType := derivedType(file.Type)
+	paths := map[string]string{}
+	for _, v := range s.variants {
+		quality := v.Quality
+		if quality == 0 {
+			quality = file.Quality
+		}
+		if quality == 0 {
+			quality = s.targetQuality
+		}
+		var buff bytes.Buffer
+		if err := encodeImage(&buff, v.Apply(img), mimeType, quality); err != nil {
+			return nil, err
+		}
+		if err := s.saveDerivative(file.Name, v.Name, mimeType, buff.Bytes()); err != nil {
+			return nil, err
+		}
+		paths[v.Name] = s.path(variantName(v.Name, file.Name))
+	}
+	return paths, nil
+}
+
+// ThumbnailPath is the path of the "thumb" variant of name, or of the first
+// configured variant when there is no "thumb".
+func (s service) ThumbnailPath(name string) string {
+	primary := s.variants[0].Name
+	for _, v := range s.variants {
+		if v.Name == "thumb" {
+			primary = v.Name
+		}
+	}
+	return s.path(variantName(primary, name))
+}
+
+func (s service) VariantPaths(name string) map[string]string {
+	paths := map[string]string{}
+	for _, v := range s.variants {
+		paths[v.Name] = s.path(variantName(v.Name, name))
+	}
+	return paths
+}
+
+func (s service) Open(name string) (Object, FileInfo, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return s.openBlob(info)
+}
+
+// OpenVariant opens the variant of name, "source" is the kept source.
+func (s service) OpenVariant(name, variant string) (Object, FileInfo, error) {
+	info, err := s.StatVariant(name, variant)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return s.openBlob(info)
+}
+
+func (s service) openBlob(info FileInfo) (Object, FileInfo, error) {
+	f, err := s.backend.Get(blobKey(info.Hash))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	// sniff content type and rewind
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+
+	info.Type = detectType(head[:n])
+	return f, info, nil
+}
+
+func (s service) Delete(name string) ([]string, error) {
+	if !checkName(name) {
+		return nil, ErrNotFound
+	}
+	if _, err := s.backend.Stat(refKey(name)); err != nil {
+		return nil, err
+	}
+
+	// derivatives go first, so a failed delete keeps the original to retry with
+	deleted := []string{}
+	failed := map[string]string{}
+	if err := s.purgeCache(name); err != nil {
+		failed[cachePrefix+name+"/"] = problem(err).detail()
+	}
+	derivatives, err := s.derivatives(name)
+	if err != nil {
+		failed[variantsPrefix+name+"/"] = problem(err).detail()
+	}
+	for _, variant := range derivatives {
+		path := s.path(variantName(variant, name))
+		if variant == sourceVariant {
+			if r, err := s.readRef(derivativeRef(name, variant)); err == nil {
+				path = s.path(sourceName(name, r.Type))
+			}
+		}
+		err := s.unlink(derivativeRef(name, variant))
+		if err == ErrNotFound {
+			continue
+		}
 		if err != nil {
-			return "", err
+			failed[path] = problem(err).detail()
+			continue
 		}
-		return path, nil
+		deleted = append(deleted, path)
 	}
-	return "", errors.New("could not resize image")
+	if len(failed) > 0 {
+		return deleted, &DeleteError{Deleted: deleted, Failed: failed}
+	}
+
+	path := s.path(name)
+	if err := s.unlink(fileRef(name)); err != nil {
+		failed[path] = problem(err).detail()
+		return deleted, &DeleteError{Deleted: deleted, Failed: failed}
+	}
+	return append(deleted, path), nil
 }
 
-func getSavePath(name string) string {
-	return fmt.Sprintf("/images/%s", name)
+// DeleteError lists the deleted files, Failed maps the others to what
+// clients are told about their failure.
+type DeleteError struct {
+	Deleted []string
+	Failed  map[string]string
 }
 
-func checkMimeType(mimeType string) bool {
-	switch mimeType {
-	case "image/jpeg", "image/jpg":
-		return true
-	case "image/png":
+func (e *DeleteError) Error() string {
+	return fmt.Sprintf("could not delete %d of %d files", len(e.Failed), len(e.Failed)+len(e.Deleted))
+}
+
+// derivatives lists the stored variants of name, the ones of variants no
+// longer configured too, and the source.
+func (s service) derivatives(name string) ([]string, error) {
+	var variants []string
+	prefix := variantsPrefix + name + "/"
+	err := s.backend.List(prefix, func(info ObjectInfo) error {
+		variants = append(variants, strings.TrimPrefix(info.Key, prefix))
+		return nil
+	})
+	return append(variants, sourceVariant), err
+}
+
+// hasDerivative tells if variant names a configured variant or the source.
+func (s service) hasDerivative(variant string) bool {
+	if variant == sourceVariant {
 		return true
-	default:
+	}
+	for _, v := range s.variants {
+		if v.Name == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeImage decodes an image the right way up, it is rotated by its
+// EXIF orientation.
+func decodeImage(r io.Reader) (image.Image, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(decodableWebP(b)))
+	if err != nil {
+		return nil, ErrBadImage.wrap(err)
+	}
+	return orient(img, imageOrientation("image/"+format, b)), nil
+}
+
+// path is the URL path a stored file is served under.
+func (s service) path(name string) string {
+	return s.publicPath + "/" + name
+}
+
+func checkName(name string) bool {
+	if name == "" || name == "." || name == ".." {
 		return false
 	}
+	return !strings.ContainsAny(name, "/\\")
 }
@@ -3,12 +3,16 @@ package app
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
-	"os"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestCheckMimeType(t *testing.T) {
@@ -45,7 +49,8 @@ func TestCheckMimeType(t *testing.T) {
 	}
 }
 
-func TestGetSavePath(t *testing.T) {
+func TestPath(t *testing.T) {
+	s := newTestService()
 	cases := []struct {
 		file string
 		path string
@@ -57,12 +62,13 @@ func TestGetSavePath(t *testing.T) {
 	}
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
-			assert.Equal(t, tc.path, getSavePath(tc.file))
+			assert.Equal(t, tc.path, s.path(tc.file))
 		})
 	}
 }
 
 func TestSaveFileSuccess(t *testing.T) {
+	s := newTestService()
 	cases := []struct {
 		file    File
 		content []byte
@@ -79,10 +85,12 @@ func TestSaveFileSuccess(t *testing.T) {
 	}
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
-			f, err := Service.SaveFile(tc.file)
+			f, err := s.SaveFile(tc.file)
 			assert.Nil(t, err)
-			assert.Equal(t, f, getSavePath(tc.file.Name))
-			b1, err := afero.ReadFile(Service.fs, getSavePath(tc.file.Name))
+			assert.Equal(t, f, s.path(tc.file.Name))
+			obj, _, err := s.Open(tc.file.Name)
+			assert.Nil(t, err)
+			b1, err := ioutil.ReadAll(obj)
 			assert.Nil(t, err)
 			assert.Equal(t, b1, tc.content)
 		})
@@ -90,6 +98,7 @@ func TestSaveFileSuccess(t *testing.T) {
 }
 
 func TestSaveFileFail(t *testing.T) {
+	s := newTestService()
 	cases := []File{
 		{
 			Name:    "bad",
@@ -101,13 +110,14 @@ func TestSaveFileFail(t *testing.T) {
 
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
-			_, err := Service.SaveFile(tc)
+			_, err := s.SaveFile(tc)
 			assert.Error(t, err)
 		})
 	}
 }
 
 func TestResize(t *testing.T) {
+	s := newTestService()
 	cases := []struct {
 		name string
 		ext  string
@@ -123,17 +133,272 @@ func TestResize(t *testing.T) {
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
 			content, err := base64.StdEncoding.DecodeString(tc.data)
-			path := getSavePath(fmt.Sprintf("thumb_%s", tc.name))
+			path := s.path(variantName("thumb", tc.name))
 			assert.Nil(t, err)
-			name, err := Service.Resize(File{
+			name, err := s.Resize(File{
 				Name:    tc.name,
 				Type:    tc.ext,
 				Content: bytes.NewReader(content),
 			})
 			assert.Nil(t, err)
-			_, err = Service.fs.Stat(path)
-			assert.False(t, os.IsNotExist(err))
+			_, err = s.StatVariant(tc.name, "thumb")
+			assert.Nil(t, err)
 			assert.Equal(t, path, name)
 		})
 	}
 }
+
+type failingFs struct {
+	afero.Fs
+	fail string
+}
+
+func (fs failingFs) Remove(name string) error {
+	if name == fs.fail {
+		return errors.New("remove failed")
+	}
+	return fs.Fs.Remove(name)
+}
+
+func TestDelete(t *testing.T) {
+	cases := []struct {
+		name     string
+		files    []string
+		variants []string
+		fail     string
+		deleted  []string
+		err      bool
+	}{
+		{
+			name:     "a.png",
+			files:    []string{"a.png"},
+			variants: []string{"old", "thumb"},
+			deleted:  []string{"/images/a.png/old", "/images/a.png/thumb", "/images/a.png"},
+		},
+		{
+			name:    "b.png",
+			files:   []string{"b.png"},
+			deleted: []string{"/images/b.png"},
+		},
+		{
+			name:     "c.png",
+			files:    []string{"c.png"},
+			variants: []string{"thumb"},
+			fail:     "/images/variants/c.png/thumb",
+			err:      true,
+		},
+		{
+			name: "missing.png",
+			err:  true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			s := NewService(NewFsBackend(failingFs{Fs: afero.NewMemMapFs(), fail: tc.fail}, "/images"), Options{})
+			var hashes []string
+			for _, f := range tc.files {
+				info, err := s.Save(File{Name: f, Type: "image/png", Content: strings.NewReader(f)})
+				assert.Nil(t, err)
+				hashes = append(hashes, info.Hash)
+			}
+			for _, variant := range tc.variants {
+				content := []byte(variant + "_" + tc.name)
+				assert.Nil(t, s.saveDerivative(tc.name, variant, "image/png", content))
+				hashes = append(hashes, contentHash(content))
+			}
+			deleted, err := s.Delete(tc.name)
+			if tc.err {
+				assert.Error(t, err)
+				_, err := s.Stat(tc.name)
+				assert.Equal(t, len(tc.files) > 0, err == nil)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.deleted, deleted)
+			for _, f := range tc.files {
+				_, err := s.Stat(f)
+				assert.Equal(t, ErrNotFound, err)
+			}
+			for _, hash := range hashes {
+				_, err = s.backend.Stat(blobKey(hash))
+				assert.Equal(t, ErrNotFound, err)
+			}
+		})
+	}
+}
+
+func TestDerivativesKeepUploads(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+	uploads := map[string]string{}
+	for _, name := range []string{"thumb_x.png", "source_y.jpg"} {
+		info, err := s.Save(File{Name: name, Type: "image/png", Content: bytes.NewReader(testPNG(16, 16))})
+		assert.Nil(t, err)
+		uploads[name] = info.Hash
+	}
+
+	content := testPNG(32, 32)
+	_, err := s.Save(File{Name: "x.png", Type: "image/png", Content: bytes.NewReader(content)})
+	assert.Nil(t, err)
+	_, err = s.Variants(File{Name: "x.png", Type: "image/png", Content: bytes.NewReader(content)})
+	assert.Nil(t, err)
+	keep := true
+	info, err := s.Save(File{Name: "y.png", Type: "image/png", Content: bytes.NewReader(content), Format: "image/jpeg", KeepSource: &keep})
+	assert.Nil(t, err)
+	assert.Equal(t, "y.jpg/source.png", info.Source)
+	for _, name := range []string{"x.png", "y.jpg"} {
+		_, err = s.Delete(name)
+		assert.Nil(t, err)
+	}
+
+	for name, hash := range uploads {
+		info, err := s.Stat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, hash, info.Hash)
+	}
+	list, err := s.List(ListQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, list.Items, 2)
+}
+
+func TestSaveDeduplication(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+
+	first, err := s.Save(File{Name: "first.png", Type: "image/png", Content: strings.NewReader("123")})
+	assert.Nil(t, err)
+	second, err := s.Save(File{Name: "second.png", Type: "image/png", Content: strings.NewReader("123")})
+	assert.Nil(t, err)
+	assert.Equal(t, first.Hash, second.Hash)
+	assert.Equal(t, "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", first.Hash)
+
+	// same content under the same name is not an overwrite
+	_, err = s.Save(File{Name: "first.png", Type: "image/png", Content: strings.NewReader("123")})
+	assert.Nil(t, err)
+
+	_, err = s.Save(File{Name: "first.png", Type: "image/png", Content: strings.NewReader("4567")})
+	assert.Equal(t, ErrExists, err)
+
+	third, err := s.Save(File{Name: "first.png", Type: "image/png", Content: strings.NewReader("4567"), Collision: CollisionOverwrite})
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Hash, third.Hash)
+	assert.Equal(t, int64(4), third.Size)
+
+	_, err = s.backend.Stat(blobKey(first.Hash))
+	assert.Nil(t, err)
+	_, err = s.Delete("second.png")
+	assert.Nil(t, err)
+	_, err = s.backend.Stat(blobKey(first.Hash))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSaveConcurrent(t *testing.T) {
+	s := newTestService()
+
+	// one upload of a name wins, the others leave no blob behind
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.Save(File{Name: "race.png", Type: "image/png", Content: strings.NewReader(fmt.Sprint(i))})
+		}(i)
+	}
+	wg.Wait()
+	saved := 0
+	for i, err := range errs {
+		_, serr := s.backend.Stat(blobKey(contentHash([]byte(fmt.Sprint(i)))))
+		if err == nil {
+			saved++
+			assert.Nil(t, serr)
+			continue
+		}
+		assert.Equal(t, ErrExists, err)
+		assert.Equal(t, ErrNotFound, serr)
+	}
+	assert.Equal(t, 1, saved)
+
+	// a blob linked while another name of it is deleted stays
+	for i := 0; i < 20; i++ {
+		_, err := s.Save(File{Name: "a.png", Type: "image/png", Content: strings.NewReader("shared")})
+		assert.Nil(t, err)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Delete("a.png")
+		}()
+		go func() {
+			defer wg.Done()
+			s.Save(File{Name: "b.png", Type: "image/png", Content: strings.NewReader("shared")})
+		}()
+		wg.Wait()
+		info, err := s.Stat("b.png")
+		assert.Nil(t, err)
+		_, err = s.backend.Stat(blobKey(info.Hash))
+		assert.Nil(t, err)
+		_, err = s.Delete("b.png")
+		assert.Nil(t, err)
+	}
+}
+
+func TestSaveStream(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 64, MaxHeight: 64, MaxBytes: 1 << 10},
+	})
+	tmpLeft := func() bool {
+		left := false
+		s.backend.List(tmpPrefix, func(ObjectInfo) error {
+			left = true
+			return nil
+		})
+		return left
+	}
+
+	content := testPNG(8, 8)
+	streamed, err := s.SaveStream(File{Name: "streamed.png", Type: "image/png", Content: iotest.OneByteReader(bytes.NewReader(content))})
+	assert.Nil(t, err)
+	assert.True(t, streamed.Created)
+	assert.Equal(t, int64(len(content)), streamed.Size)
+	saved, err := s.Save(File{Name: "saved.png", Type: "image/png", Content: bytes.NewReader(content)})
+	assert.Nil(t, err)
+	assert.Equal(t, saved.Hash, streamed.Hash)
+	_, err = s.SaveStream(File{Name: "streamed.png", Type: "image/png", Content: bytes.NewReader(testPNG(9, 9))})
+	assert.Equal(t, ErrExists, err)
+
+	_, err = s.SaveStream(File{Name: "big.png", Type: "image/png", Content: bytes.NewReader(bytes.Repeat([]byte{0}, 1<<10+1))})
+	assert.Equal(t, ErrTooLarge, err)
+	_, err = s.SaveStream(File{Name: "bomb.png", Type: "image/png", Content: bytes.NewReader(testBomb(50000, 50000))})
+	_, ok := err.(*LimitError)
+	assert.True(t, ok)
+	_, err = s.Stat("bomb.png")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.SaveStream(File{Name: "text.txt", Type: "text/plain", Content: strings.NewReader("text")})
+	assert.NotNil(t, err)
+	assert.False(t, tmpLeft())
+
+	// processed uploads are read in full
+	on := true
+	stripped, err := s.SaveStream(File{Name: "stripped.png", Type: "image/png", Content: bytes.NewReader(content), Strip: &on})
+	assert.Nil(t, err)
+	assert.Equal(t, "stripped.png", stripped.Name)
+}
+
+func TestRemoveStale(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := NewService(NewFsBackend(fs, "/images"), Options{})
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	assert.Nil(t, afero.WriteFile(fs, "/images/tmp/old", []byte("old"), 0666))
+	assert.Nil(t, fs.Chtimes("/images/tmp/old", old, old))
+	assert.Nil(t, afero.WriteFile(fs, "/images/tmp/new", []byte("new"), 0666))
+	assert.Nil(t, afero.WriteFile(fs, "/images/.tmp/put-1", []byte("old"), 0666))
+	assert.Nil(t, fs.Chtimes("/images/.tmp/put-1", old, old))
+
+	assert.Nil(t, s.removeStale(now.Add(-time.Hour)))
+	_, err := s.backend.Stat(tmpPrefix + "old")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.backend.Stat(tmpPrefix + "new")
+	assert.Nil(t, err)
+	_, err = fs.Stat("/images/.tmp/put-1")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,432 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	json2 "encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 1 << 20
+	maxChunkSize     = 16 << 20
+	maxChunks        = 10000
+	sessionsDir      = "sessions"
+	// sessionLocks is the number of locks sessions are spread over
+	sessionLocks = 64
+)
+
+var (
+	ErrBadSession       = newError(http.StatusBadRequest, "bad_session", "size should be positive, hash a hex SHA-256 and chunk_size at most 16M")
+	ErrTooManyChunks    = newError(http.StatusBadRequest, "too_many_chunks", "too many chunks, use a larger chunk_size")
+	ErrSessionNotFound  = newError(http.StatusNotFound, "session_not_found", "session not found")
+	ErrBadChunk         = newError(http.StatusNotFound, "bad_chunk", "no such chunk")
+	ErrChunkSize        = newError(http.StatusBadRequest, "chunk_size", "chunk does not have the size of its place in the file")
+	ErrMissingChunks    = newError(http.StatusConflict, "missing_chunks", "chunks are missing")
+	ErrChecksumMismatch = newError(http.StatusUnprocessableEntity, "checksum_mismatch", "assembled file does not match the hash")
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// UploadSession is a file uploaded in numbered chunks of ChunkSize bytes,
+// the last one holding the rest. Received lists the chunks already stored.
+// The session is removed once it Expires.
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"`
+	ChunkSize int64     `json:"chunk_size"`
+	Chunks    int       `json:"chunks"`
+	Received  []int     `json:"received"`
+	Expires   time.Time `json:"expires"`
+}
+
+// chunkLength is the size chunk n has to have.
+func (u UploadSession) chunkLength(n int) int64 {
+	if n == u.Chunks-1 {
+		return u.Size - int64(n)*u.ChunkSize
+	}
+	return u.ChunkSize
+}
+
+// sessionStore keeps upload sessions on an afero.Fs, every one in its own
+// directory with a session file and a file per received chunk. Chunks are
+// written next to their place and renamed into it, so a chunk is either
+// complete or missing. Chunks of a session are written in parallel under
+// its read lock, finalizing, aborting and expiring take the write lock.
+// Sessions share a fixed set of locks, so ids sent by clients take no
+// memory.
+type sessionStore struct {
+	fs     afero.Fs
+	expiry time.Duration
+	locks  [sessionLocks]sync.RWMutex
+}
+
+func newSessionStore(fs afero.Fs, expiry time.Duration) *sessionStore {
+	return &sessionStore{fs: fs, expiry: expiry}
+}
+
+func (s *sessionStore) lock(id string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.locks[h.Sum32()%sessionLocks]
+}
+
+func (s *sessionStore) create(name string, size int64, hash string, chunkSize int64) (UploadSession, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	hash = strings.ToLower(hash)
+	if size <= 0 || !sha256Hex.MatchString(hash) || chunkSize < 0 || chunkSize > maxChunkSize {
+		return UploadSession{}, ErrBadSession
+	}
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks > maxChunks {
+		return UploadSession{}, ErrTooManyChunks
+	}
+	session := UploadSession{
+		ID:        newUUID(),
+		Name:      name,
+		Size:      size,
+		Hash:      hash,
+		ChunkSize: chunkSize,
+		Chunks:    int(chunks),
+		Received:  []int{},
+		Expires:   time.Now().Add(s.expiry).UTC(),
+	}
+	if err := s.fs.MkdirAll(s.dir(session.ID), 0777); err != nil {
+		return UploadSession{}, err
+	}
+	b, err := json2.Marshal(session)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if err := afero.WriteFile(s.fs, path.Join(s.dir(session.ID), "session"), b, 0666); err != nil {
+		s.fs.RemoveAll(s.dir(session.ID))
+		return UploadSession{}, err
+	}
+	return session, nil
+}
+
+func (s *sessionStore) get(id string) (UploadSession, error) {
+	if !tusID.MatchString(id) {
+		return UploadSession{}, ErrSessionNotFound
+	}
+	b, err := afero.ReadFile(s.fs, path.Join(s.dir(id), "session"))
+	if os.IsNotExist(err) {
+		return UploadSession{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+	var session UploadSession
+	if err := json2.Unmarshal(b, &session); err != nil {
+		return UploadSession{}, err
+	}
+	if session.expired(time.Now()) {
+		return UploadSession{}, ErrSessionNotFound
+	}
+	infos, err := afero.ReadDir(s.fs, s.dir(id))
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session.Received = []int{}
+	for _, info := range infos {
+		if n, err := strconv.Atoi(info.Name()); err == nil {
+			session.Received = append(session.Received, n)
+		}
+	}
+	sort.Ints(session.Received)
+	return session, nil
+}
+
+// put stores chunk n, replacing an earlier upload of it.
+func (s *sessionStore) put(id string, n int, r io.Reader) error {
+	l := s.lock(id)
+	l.RLock()
+	defer l.RUnlock()
+
+	session, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= session.Chunks {
+		return ErrBadChunk
+	}
+	part, err := afero.TempFile(s.fs, s.dir(id), "part-")
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(part, io.LimitReader(r, session.chunkLength(n)+1))
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && written != session.chunkLength(n) {
+		err = ErrChunkSize
+	}
+	if err != nil {
+		s.fs.Remove(part.Name())
+		return err
+	}
+	return s.fs.Rename(part.Name(), s.chunk(id, n))
+}
+
+// missing lists the chunks not received yet.
+func (s *sessionStore) missing(session UploadSession) []int {
+	missing := []int{}
+	received := 0
+	for n := 0; n < session.Chunks; n++ {
+		if received < len(session.Received) && session.Received[received] == n {
+			received++
+			continue
+		}
+		missing = append(missing, n)
+	}
+	return missing
+}
+
+// open reads the chunks of a complete session in order as one file.
+func (s *sessionStore) open(session UploadSession) io.ReadCloser {
+	return &chunksReader{store: s, session: session}
+}
+
+// remove drops a session, the caller holds its write lock.
+func (s *sessionStore) remove(id string) error {
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+	return s.fs.RemoveAll(s.dir(id))
+}
+
+// removeExpired drops the sessions that expired before now, and the
+// directories without a readable session file left by a failed create.
+func (s *sessionStore) removeExpired(now time.Time) error {
+	infos, err := afero.ReadDir(s.fs, sessionsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		id := info.Name()
+		if !info.IsDir() || !tusID.MatchString(id) {
+			continue
+		}
+		if err := s.removeIfExpired(id, info.ModTime(), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sessionStore) removeIfExpired(id string, modified, now time.Time) error {
+	l := s.lock(id)
+	l.Lock()
+	defer l.Unlock()
+
+	var session UploadSession
+	b, err := afero.ReadFile(s.fs, path.Join(s.dir(id), "session"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil || json2.Unmarshal(b, &session) != nil {
+		// expires with the directory
+		session = UploadSession{}
+	}
+	if session.Expires.IsZero() {
+		session.Expires = modified.Add(s.expiry)
+	}
+	if !session.expired(now) {
+		return nil
+	}
+	err = s.fs.RemoveAll(s.dir(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (u UploadSession) expired(now time.Time) bool {
+	return !u.Expires.IsZero() && !now.Before(u.Expires)
+}
+
+func (s *sessionStore) dir(id string) string {
+	return path.Join(sessionsDir, id)
+}
+
+func (s *sessionStore) chunk(id string, n int) string {
+	return path.Join(s.dir(id), strconv.Itoa(n))
+}
+
+// chunksReader opens the chunk files one after the other.
+type chunksReader struct {
+	store   *sessionStore
+	session UploadSession
+	next    int
+	current afero.File
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next == r.session.Chunks {
+				return 0, io.EOF
+			}
+			f, err := r.store.fs.Open(r.store.chunk(r.session.ID, r.next))
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+func (h handlers) sessionCreate(c *gin.Context) {
+	var data struct {
+		Name      string `json:"name"`
+		Size      int64  `json:"size"`
+		Hash      string `json:"hash"`
+		ChunkSize int64  `json:"chunk_size"`
+	}
+	if err := c.BindJSON(&data); err != nil {
+		errorResponse(c, fmt.Sprintf("could not unmarshal session: %s", err.Error()))
+		return
+	}
+	if err := h.service.CheckSize(data.Size); err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+	session, err := h.service.sessions.create(data.Name, data.Size, data.Hash, data.ChunkSize)
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.JSON(http.StatusCreated, session)
+}
+
+func (h handlers) sessionGet(c *gin.Context) {
+	session, err := h.service.sessions.get(c.Param("id"))
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+func (h handlers) sessionChunk(c *gin.Context) {
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		problemResponse(c, ErrBadChunk, nil)
+		return
+	}
+	if err := h.service.sessions.put(c.Param("id"), n, c.Request.Body); err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// sessionFinalize checks that every chunk is there and that they add up to
+// the announced hash, then stores the file. The session is removed once the
+// file is stored or refused for good, a checksum mismatch included. After a
+// server failure it is kept, so finalizing can be retried.
+func (h handlers) sessionFinalize(c *gin.Context) {
+	id := c.Param("id")
+	options, err := saveOptions(formParams(c))
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+	l := h.service.sessions.lock(id)
+	l.Lock()
+	defer l.Unlock()
+
+	session, err := h.service.sessions.get(id)
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	if missing := h.service.sessions.missing(session); len(missing) > 0 {
+		problemResponse(c, ErrMissingChunks, gin.H{"missing": missing})
+		return
+	}
+
+	content := h.service.sessions.open(session)
+	hash := sha256.New()
+	_, err = io.Copy(hash, content)
+	content.Close()
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != session.Hash {
+		h.service.sessions.remove(id)
+		problemResponse(c, ErrChecksumMismatch, nil)
+		return
+	}
+
+	content = h.service.sessions.open(session)
+	defer content.Close()
+	upload := options
+	upload.Name = session.Name
+	batch := newUploadBatch(h.service, false)
+	batch.saveReader(upload, content)
+	result := batch.results[0]
+	if result.File == nil {
+		if result.Status < http.StatusInternalServerError {
+			h.service.sessions.remove(id)
+		}
+		problemResponse(c, result.err(), nil)
+		return
+	}
+	if err := h.service.sessions.remove(id); err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (h handlers) sessionAbort(c *gin.Context) {
+	id := c.Param("id")
+	l := h.service.sessions.lock(id)
+	l.Lock()
+	defer l.Unlock()
+	if err := h.service.sessions.remove(id); err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
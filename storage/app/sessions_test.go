@@ -0,0 +1,188 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	json2 "encoding/json"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sessionRequest(s *service, method, url string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	return performRequest(NewRouter(s), req)
+}
+
+func newSession(t *testing.T, s *service, name string, content []byte, chunkSize int) UploadSession {
+	sum := sha256.Sum256(content)
+	body, _ := json2.Marshal(map[string]interface{}{
+		"name":       name,
+		"size":       len(content),
+		"hash":       hex.EncodeToString(sum[:]),
+		"chunk_size": chunkSize,
+	})
+	resp := sessionRequest(s, "POST", "/storage/sessions", body)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var session UploadSession
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &session))
+	return session
+}
+
+func putChunk(s *service, session UploadSession, content []byte, n int) *httptest.ResponseRecorder {
+	start := int64(n) * session.ChunkSize
+	end := start + session.chunkLength(n)
+	return sessionRequest(s, "PUT", fmt.Sprintf("/storage/sessions/%s/chunks/%d", session.ID, n), content[start:end])
+}
+
+func TestSessions(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 20},
+	})
+
+	content := testPNG(64, 64)
+	chunkSize := len(content)/3 + 1
+	session := newSession(t, s, "chunked.png", content, chunkSize)
+	assert.Equal(t, 3, session.Chunks)
+	assert.Equal(t, []int{}, session.Received)
+	url := "/storage/sessions/" + session.ID
+
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 2).Code)
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+	// a chunk can be sent again
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+
+	resp := sessionRequest(s, "PUT", url+"/chunks/1", content[:10])
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = sessionRequest(s, "PUT", url+"/chunks/3", nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = sessionRequest(s, "PUT", url+"/chunks/x", nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = sessionRequest(s, "GET", url, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &session))
+	assert.Equal(t, []int{0, 2}, session.Received)
+
+	resp = sessionRequest(s, "POST", url+"/finalize", nil)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.JSONEq(t, `{"type": "about:blank", "title": "Conflict", "status": 409, "code": "missing_chunks", "detail": "chunks are missing", "missing": [1]}`, resp.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 1).Code)
+	resp = sessionRequest(s, "POST", url+"/finalize?naming=original", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result UploadResultDTO
+	assert.Nil(t, json2.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, "chunked.png", result.File.Name)
+	assert.Equal(t, "/images/chunked.png/thumb", result.File.Resize)
+
+	info, err := s.Stat("chunked.png")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	_, err = s.StatVariant("chunked.png", "thumb")
+	assert.Nil(t, err)
+
+	// the session is gone
+	resp = sessionRequest(s, "GET", url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = sessionRequest(s, "POST", url+"/finalize", nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestSessionsRejected(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 20},
+	})
+
+	hash := hex.EncodeToString(make([]byte, 32))
+	cases := []struct {
+		body string
+		code int
+	}{
+		{`{"name": "a.png", "size": 10, "hash": "` + hash + `"}`, http.StatusCreated},
+		{`{"name": "a.png", "size": 0, "hash": "` + hash + `"}`, http.StatusBadRequest},
+		{`{"name": "a.png", "size": 10, "hash": "abc"}`, http.StatusBadRequest},
+		{`{"name": "a.png", "size": 10, "hash": "` + hash + `", "chunk_size": 33554432}`, http.StatusBadRequest},
+		{`{"name": "a.png", "size": 100000, "hash": "` + hash + `", "chunk_size": 1}`, http.StatusBadRequest},
+		{`{"name": "a.png", "size": 2097152, "hash": "` + hash + `"}`, http.StatusRequestEntityTooLarge},
+		{`not json`, http.StatusBadRequest},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			resp := sessionRequest(s, "POST", "/storage/sessions", []byte(tc.body))
+			assert.Equal(t, tc.code, resp.Code)
+		})
+	}
+
+	// the hash is checked on finalize and the session dropped
+	content := testPNG(16, 16)
+	session := newSession(t, s, "bad.png", content, 0)
+	assert.Equal(t, 1, session.Chunks)
+	content[len(content)-1] ^= 0xff
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+	resp := sessionRequest(s, "POST", "/storage/sessions/"+session.ID+"/finalize", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	resp = sessionRequest(s, "GET", "/storage/sessions/"+session.ID, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	_, err := s.Stat("bad.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	// aborting drops the chunks
+	session = newSession(t, s, "aborted.png", content, 0)
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+	resp = sessionRequest(s, "DELETE", "/storage/sessions/"+session.ID, nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = sessionRequest(s, "DELETE", "/storage/sessions/"+session.ID, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = sessionRequest(s, "GET", "/storage/sessions/../../etc", nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestSessionsRetry(t *testing.T) {
+	backend := &flakyBackend{Backend: NewFsBackend(afero.NewMemMapFs(), "/images"), failures: 1}
+	s := NewService(backend, Options{})
+
+	content := testPNG(16, 16)
+	session := newSession(t, s, "retried.png", content, 0)
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+	url := "/storage/sessions/" + session.ID
+
+	// a storage failure keeps the chunks for a retry
+	resp := sessionRequest(s, "POST", url+"/finalize", nil)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	resp = sessionRequest(s, "GET", url, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = sessionRequest(s, "POST", url+"/finalize", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = sessionRequest(s, "GET", url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestSessionsExpire(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{Uploads: fs, UploadExpiry: time.Hour})
+
+	content := testPNG(16, 16)
+	session := newSession(t, s, "abandoned.png", content, 0)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.Expires, time.Minute)
+	assert.Equal(t, http.StatusNoContent, putChunk(s, session, content, 0).Code)
+	// a directory left without a session file by a failed create
+	assert.Nil(t, fs.MkdirAll(sessionsDir+"/"+newUUID(), 0777))
+
+	assert.Nil(t, s.removeExpired(time.Now()))
+	resp := sessionRequest(s, "GET", "/storage/sessions/"+session.ID, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	assert.Nil(t, s.removeExpired(time.Now().Add(2*time.Hour)))
+	infos, err := afero.ReadDir(fs, sessionsDir)
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+	resp = sessionRequest(s, "GET", "/storage/sessions/"+session.ID, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
@@ -0,0 +1,221 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+const cachePrefix = "cache/"
+
+var (
+	DefaultTransformSizes     = []uint{64, 128, 256, 512, 1024, 2048}
+	DefaultTransformQualities = []int{50, 75, 90}
+)
+
+type TransformError struct {
+	Message string
+}
+
+func (e *TransformError) Error() string {
+	return e.Message
+}
+
+// Transform describes an on the fly rendering of a stored image. Zero
+// values mean "as the original".
+type Transform struct {
+	Width   uint
+	Height  uint
+	Fit     Fit
+	Format  string
+	Quality int
+}
+
+// Transform renders the image once, keeps the result under cache/<name>/
+// and serves later requests for the same transform from there.
+func (s service) Transform(name string, t Transform) (Object, FileInfo, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	if t.Format == "" {
+		t.Format = derivedType(info.Type)
+	}
+	if err := s.checkTransform(&t); err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	key := cacheKey(name, info.Hash, t)
+	obj, cached, err := s.openCached(key, name, t.Format)
+	if err != ErrNotFound {
+		return obj, cached, err
+	}
+
+	src, err := s.backend.Get(blobKey(info.Hash))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	img, err := s.limits.decode(src)
+	src.Close()
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	if t.Width != 0 || t.Height != 0 {
+		img = t.variant(img.Bounds()).Apply(img)
+	}
+	var buff bytes.Buffer
+	if err := encodeImage(&buff, img, t.Format, t.Quality); err != nil {
+		return nil, FileInfo{}, err
+	}
+	if err := s.backend.Put(key, bytes.NewReader(buff.Bytes())); err != nil {
+		return nil, FileInfo{}, err
+	}
+	return s.openCached(key, name, t.Format)
+}
+
+func (s service) checkTransform(t *Transform) error {
+	t.Format = canonicalMimeType(t.Format)
+	if f, ok := formatFor(t.Format); !ok || f.Encode == nil {
+		return &TransformError{fmt.Sprintf("unsupported format %s", t.Format)}
+	}
+	if t.Fit == "" {
+		t.Fit = FitContain
+	}
+	switch t.Fit {
+	case FitContain:
+	case FitCover, FitExact:
+		if t.Width == 0 || t.Height == 0 {
+			return &TransformError{fmt.Sprintf("fit %s needs both width and height", t.Fit)}
+		}
+	default:
+		return &TransformError{"fit should be one of contain, cover, exact"}
+	}
+	if !s.allowedSize(t.Width) || !s.allowedSize(t.Height) {
+		return &TransformError{"size is not allowed"}
+	}
+	if t.Quality != 0 && !s.allowedQuality(t.Quality) {
+		return &TransformError{"quality is not allowed"}
+	}
+	return nil
+}
+
+func (s service) allowedSize(size uint) bool {
+	if size == 0 {
+		return true
+	}
+	for _, allowed := range s.transformSizes {
+		if size == allowed {
+			return true
+		}
+	}
+	for _, v := range s.variants {
+		if size == v.Width || size == v.Height {
+			return true
+		}
+	}
+	return false
+}
+
+func (s service) allowedQuality(quality int) bool {
+	for _, allowed := range s.transformQualities {
+		if quality == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// openCached opens a rendering, its hash is the one of the key, which
+// holds the source hash and every parameter of the transform.
+func (s service) openCached(key, name, mimeType string) (Object, FileInfo, error) {
+	stat, err := s.backend.Stat(key)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	obj, err := s.backend.Get(key)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return obj, FileInfo{
+		Name:     name,
+		Size:     stat.Size,
+		Type:     mimeType,
+		Hash:     hex.EncodeToString(sum[:]),
+		Modified: stat.Modified,
+	}, nil
+}
+
+// purgeCache drops every cached transform of name.
+func (s service) purgeCache(name string) error {
+	var keys []string
+	err := s.backend.List(cachePrefix+name+"/", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.backend.Delete(key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// variant turns the transform into a preset, a missing dimension of a
+// "contain" transform is bounded by the original only.
+func (t Transform) variant(bounds image.Rectangle) Variant {
+	v := Variant{Width: t.Width, Height: t.Height, Fit: t.Fit, Quality: t.Quality}
+	if v.Width == 0 {
+		v.Width = uint(bounds.Dx())
+	}
+	if v.Height == 0 {
+		v.Height = uint(bounds.Dy())
+	}
+	return v
+}
+
+func cacheKey(name, hash string, t Transform) string {
+	ext := strings.TrimPrefix(t.Format, "image/")
+	// the source hash in the key keeps stale renders of an overwritten
+	// file from being served
+	return fmt.Sprintf("%s%s/%s_%dx%d_%s_q%d.%s", cachePrefix, name, hash[:16], t.Width, t.Height, t.Fit, t.Quality, ext)
+}
+
+func ParseSizes(spec string) ([]uint, error) {
+	var sizes []uint
+	for _, item := range strings.Split(spec, ",") {
+		size, err := strconv.ParseUint(strings.TrimSpace(item), 10, 32)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("bad size %q", item)
+		}
+		sizes = append(sizes, uint(size))
+	}
+	return sizes, nil
+}
+
+func ParseQualities(spec string) ([]int, error) {
+	var qualities []int
+	for _, item := range strings.Split(spec, ",") {
+		quality, err := ParseQuality(item)
+		if err != nil {
+			return nil, err
+		}
+		qualities = append(qualities, quality)
+	}
+	return qualities, nil
+}
+
+func ParseQuality(s string) (int, error) {
+	quality, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("bad quality %q", s)
+	}
+	return quality, nil
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func testPNG(width, height int) []byte {
+	var buff bytes.Buffer
+	png.Encode(&buff, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return buff.Bytes()
+}
+
+func TestTransform(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		TransformSizes:     []uint{16, 32},
+		TransformQualities: []int{80},
+	})
+	_, err := s.Save(File{Name: "t.png", Type: "image/png", Content: bytes.NewReader(testPNG(64, 48))})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		transform Transform
+		mime      string
+		width     int
+		height    int
+		err       bool
+	}{
+		{transform: Transform{Width: 32}, mime: "image/png", width: 32, height: 24},
+		{transform: Transform{Height: 16}, mime: "image/png", width: 21, height: 16},
+		{transform: Transform{Width: 32, Height: 32, Fit: FitCover}, mime: "image/png", width: 32, height: 32},
+		{transform: Transform{Width: 16, Height: 32, Fit: FitExact}, mime: "image/png", width: 16, height: 32},
+		{transform: Transform{Width: 100}, mime: "image/png", width: 64, height: 48},
+		{transform: Transform{Format: "image/jpeg", Quality: 80}, mime: "image/jpeg", width: 64, height: 48},
+		{transform: Transform{Width: 33}, err: true},
+		{transform: Transform{Width: 32, Quality: 81}, err: true},
+		{transform: Transform{Width: 32, Fit: FitCover}, err: true},
+		{transform: Transform{Width: 32, Fit: "stretch"}, err: true},
+		{transform: Transform{Format: "image/webp"}, err: true},
+		{transform: Transform{Format: "image/svg+xml"}, err: true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			obj, info, err := s.Transform("t.png", tc.transform)
+			if tc.err {
+				_, ok := err.(*TransformError)
+				assert.True(t, ok)
+				return
+			}
+			assert.Nil(t, err)
+			defer obj.Close()
+			assert.Equal(t, tc.mime, info.Type)
+			img, format, err := image.Decode(obj)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.mime, "image/"+format)
+			assert.Equal(t, tc.width, img.Bounds().Dx())
+			assert.Equal(t, tc.height, img.Bounds().Dy())
+		})
+	}
+}
+
+func TestTransformCache(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{})
+	_, err := s.Save(File{Name: "c.png", Type: "image/png", Content: bytes.NewReader(testPNG(64, 48))})
+	assert.Nil(t, err)
+
+	countCached := func() int {
+		n := 0
+		s.backend.List(cachePrefix+"c.png/", func(ObjectInfo) error {
+			n++
+			return nil
+		})
+		return n
+	}
+
+	for i := 0; i < 2; i++ {
+		obj, _, err := s.Transform("c.png", Transform{Width: 64})
+		assert.Nil(t, err)
+		obj.Close()
+		assert.Equal(t, 1, countCached())
+	}
+
+	// overwriting the original drops its renders
+	_, err = s.Save(File{Name: "c.png", Type: "image/png", Content: bytes.NewReader(testPNG(32, 32)), Collision: CollisionOverwrite})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countCached())
+
+	obj, info, err := s.Transform("c.png", Transform{Width: 64})
+	assert.Nil(t, err)
+	obj.Close()
+	assert.Equal(t, "image/png", info.Type)
+	assert.Equal(t, 1, countCached())
+
+	_, err = s.Delete("c.png")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countCached())
+}
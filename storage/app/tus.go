@@ -0,0 +1,476 @@
+package app
+
+import (
+	"encoding/base64"
+	json2 "encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus 1.0 core with the creation, expiration and termination extensions,
+// https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusPath       = "/storage/tus/"
+)
+
+var (
+	ErrUploadNotFound = newError(http.StatusNotFound, "upload_not_found", "upload not found")
+	ErrOffsetMismatch = newError(http.StatusConflict, "offset_mismatch", "upload offset does not match")
+	ErrUploadBusy     = newError(http.StatusLocked, "upload_busy", "upload is being written")
+)
+
+var tusID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// TusUpload is the state of a resumable upload. It is removed once it was
+// stored or when it Expires.
+type TusUpload struct {
+	ID       string            `json:"-"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"-"`
+	Metadata map[string]string `json:"metadata"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// tusStore keeps resumable uploads on an afero.Fs: <id>.bin holds the
+// bytes received so far and <id>.info the upload itself. Writes to one
+// upload are exclusive, a second one is turned away instead of waiting.
+type tusStore struct {
+	keyLocks
+	fs     afero.Fs
+	expiry time.Duration
+}
+
+func newTusStore(fs afero.Fs, expiry time.Duration) *tusStore {
+	return &tusStore{keyLocks: newKeyLocks(), fs: fs, expiry: expiry}
+}
+
+func (t *tusStore) create(length int64, metadata map[string]string) (TusUpload, error) {
+	upload := TusUpload{ID: newUUID(), Length: length, Metadata: metadata, Expires: time.Now().Add(t.expiry).UTC()}
+	f, err := t.fs.OpenFile(upload.ID+".bin", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	f.Close()
+	if err := t.writeInfo(upload); err != nil {
+		t.fs.Remove(upload.ID + ".bin")
+		return TusUpload{}, err
+	}
+	return upload, nil
+}
+
+func (t *tusStore) get(id string) (TusUpload, error) {
+	if !tusID.MatchString(id) {
+		return TusUpload{}, ErrUploadNotFound
+	}
+	b, err := afero.ReadFile(t.fs, id+".info")
+	if os.IsNotExist(err) {
+		return TusUpload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload := TusUpload{ID: id}
+	if err := json2.Unmarshal(b, &upload); err != nil {
+		return TusUpload{}, err
+	}
+	if !upload.Expires.IsZero() && !time.Now().Before(upload.Expires) {
+		return TusUpload{}, ErrUploadNotFound
+	}
+	stat, err := t.fs.Stat(id + ".bin")
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload.Offset = stat.Size()
+	return upload, nil
+}
+
+// write appends r at offset, stopping at the upload length. Whatever was
+// received is kept when r fails, so the client can resume from there.
+func (t *tusStore) write(id string, offset int64, r io.Reader) (TusUpload, error) {
+	if !t.lock(id) {
+		return TusUpload{}, ErrUploadBusy
+	}
+	defer t.unlock(id)
+
+	upload, err := t.get(id)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+	f, err := t.fs.OpenFile(id+".bin", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, upload.Length-upload.Offset))
+	upload.Offset += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return upload, err
+}
+
+// open reads the received bytes of a complete upload.
+func (t *tusStore) open(id string) (afero.File, error) {
+	return t.fs.Open(id + ".bin")
+}
+
+func (t *tusStore) remove(id string) error {
+	if !t.lock(id) {
+		return ErrUploadBusy
+	}
+	defer t.unlock(id)
+
+	if _, err := t.get(id); err != nil {
+		return err
+	}
+	return t.drop(id)
+}
+
+// drop removes an upload without taking its lock.
+func (t *tusStore) drop(id string) error {
+	err := t.fs.Remove(id + ".bin")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = t.fs.Remove(id + ".info")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeExpired drops the uploads that expired before now, uploads being
+// written are left for the next sweep. Files without a readable .info
+// expire with their modification time.
+func (t *tusStore) removeExpired(now time.Time) error {
+	infos, err := afero.ReadDir(t.fs, "")
+	if err != nil {
+		return err
+	}
+	modified := map[string]time.Time{}
+	for _, info := range infos {
+		ext := path.Ext(info.Name())
+		id := strings.TrimSuffix(info.Name(), ext)
+		if info.IsDir() || (ext != ".bin" && ext != ".info") || !tusID.MatchString(id) {
+			continue
+		}
+		if m, ok := modified[id]; !ok || info.ModTime().After(m) {
+			modified[id] = info.ModTime()
+		}
+	}
+	for id, m := range modified {
+		if !t.lock(id) {
+			continue
+		}
+		err := t.removeIfExpired(id, m, now)
+		t.unlock(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tusStore) removeIfExpired(id string, modified, now time.Time) error {
+	var upload TusUpload
+	b, err := afero.ReadFile(t.fs, id+".info")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil || json2.Unmarshal(b, &upload) != nil {
+		// expires with its files
+		upload = TusUpload{}
+	}
+	if upload.Expires.IsZero() {
+		upload.Expires = modified.Add(t.expiry)
+	}
+	if now.Before(upload.Expires) {
+		return nil
+	}
+	return t.drop(id)
+}
+
+func (t *tusStore) writeInfo(upload TusUpload) error {
+	b, err := json2.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(t.fs, upload.ID+".info", b, 0666)
+}
+
+// keyLocks are try-locks by key.
+type keyLocks struct {
+	mu   *sync.Mutex
+	busy map[string]bool
+}
+
+func newKeyLocks() keyLocks {
+	return keyLocks{mu: &sync.Mutex{}, busy: map[string]bool{}}
+}
+
+func (l keyLocks) lock(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy[key] {
+		return false
+	}
+	l.busy[key] = true
+	return true
+}
+
+func (l keyLocks) unlock(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.busy, key)
+}
+
+// ParseTusMetadata reads an Upload-Metadata header, comma separated keys
+// with base64 encoded values.
+func ParseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Fields(pair)
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("bad metadata %q", pair)
+		}
+		value := ""
+		if len(parts) == 2 {
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad metadata value of %q", parts[0])
+			}
+			value = string(b)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	var pairs []string
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// tusOptions reads the save options from the upload metadata.
+func tusOptions(metadata map[string]string) (File, error) {
+	return saveOptions(func(key string) string {
+		return metadata[key]
+	})
+}
+
+// tusResumable checks the protocol version of the client.
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.Request.Method == http.MethodOptions {
+		return
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		problemResponse(c, newError(http.StatusPreconditionFailed, "tus_version", fmt.Sprintf("only tus %s is supported", tusVersion)), nil)
+		c.Abort()
+	}
+}
+
+func (h handlers) tusOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if max := h.service.MaxBytes(); max > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(max, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h handlers) tusCreate(c *gin.Context) {
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		errorResponse(c, "deferred upload length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		errorResponse(c, "Upload-Length should be a size in bytes")
+		return
+	}
+	if err := h.service.CheckSize(length); err != nil {
+		problemResponse(c, err, nil)
+		return
+	}
+	metadata, err := ParseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+	if _, err := tusOptions(metadata); err != nil {
+		errorResponse(c, err.Error())
+		return
+	}
+	upload, err := h.service.tus.create(length, metadata)
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.Header("Location", tusPath+upload.ID)
+	c.Header("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	if length == 0 {
+		h.tusComplete(c, upload, http.StatusCreated)
+		return
+	}
+	c.Status(http.StatusCreated)
+}
+
+func (h handlers) tusHead(c *gin.Context) {
+	upload, ok := h.tusUpload(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	if len(upload.Metadata) > 0 {
+		c.Header("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h handlers) tusPatch(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		problemResponse(c, ErrUnsupportedType.with("Content-Type should be application/offset+octet-stream"), nil)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		errorResponse(c, "Upload-Offset should be a position in bytes")
+		return
+	}
+	upload, err := h.service.tus.write(c.Param("id"), offset, c.Request.Body)
+	switch err {
+	case nil:
+	case ErrUploadNotFound, ErrUploadBusy:
+		problemResponse(c, err, nil)
+		return
+	case ErrOffsetMismatch:
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		problemResponse(c, err, nil)
+		return
+	default:
+		if upload.ID == "" {
+			problemResponse(c, ErrStorage.wrap(err), nil)
+			return
+		}
+		// the client resumes from the offset it finds with HEAD
+		errorResponse(c, fmt.Sprintf("could not read upload: %s", err.Error()))
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	if upload.Offset == upload.Length {
+		h.tusComplete(c, upload, http.StatusNoContent)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// tusComplete runs a complete upload through the usual upload pipeline
+// and removes it once stored. An upload refused for good, over a limit,
+// not an image or colliding, is removed too, retrying it would fail the
+// same way. After a server failure it is kept, the client retries with an
+// empty PATCH at the final offset.
+func (h handlers) tusComplete(c *gin.Context, upload TusUpload, status int) {
+	if !h.service.tus.lock(upload.ID) {
+		problemResponse(c, ErrUploadBusy, nil)
+		return
+	}
+	defer h.service.tus.unlock(upload.ID)
+
+	// a concurrent request may have stored it meanwhile
+	upload, err := h.service.tus.get(upload.ID)
+	if err == ErrUploadNotFound {
+		problemResponse(c, err, nil)
+		return
+	}
+	var result UploadResultDTO
+	if err == nil {
+		result, err = h.tusSave(upload)
+	}
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	if result.File == nil {
+		if result.Status < http.StatusInternalServerError {
+			h.service.tus.drop(upload.ID)
+		}
+		problemResponse(c, result.err(), nil)
+		return
+	}
+	if err := h.service.tus.drop(upload.ID); err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.Header("File-Path", h.service.path(result.File.Name))
+	c.Status(status)
+}
+
+// tusSave stores the received bytes with the options and file name from
+// the metadata.
+func (h handlers) tusSave(upload TusUpload) (UploadResultDTO, error) {
+	options, err := tusOptions(upload.Metadata)
+	if err != nil {
+		return UploadResultDTO{}, err
+	}
+	f, err := h.service.tus.open(upload.ID)
+	if err != nil {
+		return UploadResultDTO{}, err
+	}
+	defer f.Close()
+
+	file := options
+	file.Name = upload.Metadata["filename"]
+	batch := newUploadBatch(h.service, false)
+	batch.saveReader(file, f)
+	return batch.results[0], nil
+}
+
+func (h handlers) tusTerminate(c *gin.Context) {
+	if err := h.service.tus.remove(c.Param("id")); err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h handlers) tusUpload(c *gin.Context) (TusUpload, bool) {
+	upload, err := h.service.tus.get(c.Param("id"))
+	if err == ErrUploadNotFound {
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusNotFound)
+		return TusUpload{}, false
+	}
+	if err != nil {
+		problemResponse(c, ErrStorage.wrap(err), nil)
+		return TusUpload{}, false
+	}
+	return upload, true
+}
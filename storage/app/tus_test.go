@@ -0,0 +1,226 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tusRequest(s *service, method, url string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return performRequest(NewRouter(s), req)
+}
+
+func tusPatchRequest(s *service, url string, offset int, body []byte) *httptest.ResponseRecorder {
+	return tusRequest(s, "PATCH", url, body, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	cases := []struct {
+		header   string
+		metadata map[string]string
+		err      bool
+	}{
+		{"", map[string]string{}, false},
+		{"filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential", map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": ""}, false},
+		{"filename  dGVzdC5wbmc= , naming dXVpZA==", map[string]string{"filename": "test.png", "naming": "uuid"}, false},
+		{"filename not-base64", nil, true},
+		{"a b c", nil, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			metadata, err := ParseTusMetadata(tc.header)
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.metadata, metadata)
+		})
+	}
+}
+
+func TestTus(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 20},
+	})
+
+	resp := tusRequest(s, "OPTIONS", "/storage/tus/", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "1.0.0", resp.Header().Get("Tus-Version"))
+	assert.Equal(t, "creation,expiration,termination", resp.Header().Get("Tus-Extension"))
+	assert.Equal(t, "1048576", resp.Header().Get("Tus-Max-Size"))
+
+	content := testPNG(32, 32)
+	resp = tusRequest(s, "POST", "/storage/tus/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("resumed.png")),
+	})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	location := resp.Header().Get("Location")
+	assert.Regexp(t, `^/storage/tus/[0-9a-f-]{36}$`, location)
+	expires, err := http.ParseTime(resp.Header().Get("Upload-Expires"))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(DefaultUploadExpiry), expires, time.Minute)
+
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "0", resp.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header().Get("Upload-Length"))
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+
+	half := len(content) / 2
+	resp = tusPatchRequest(s, location, 0, content[:half])
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, strconv.Itoa(half), resp.Header().Get("Upload-Offset"))
+	assert.Equal(t, "", resp.Header().Get("File-Path"))
+
+	resp = tusPatchRequest(s, location, 0, content[:half])
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, strconv.Itoa(half), resp.Header().Get("Upload-Offset"))
+
+	resp = tusRequest(s, "PATCH", location, content[half:], map[string]string{"Upload-Offset": strconv.Itoa(half)})
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.Code)
+
+	resp = tusPatchRequest(s, location, half, append(content[half:], "trailing"...))
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header().Get("Upload-Offset"))
+	assert.Equal(t, "/images/resumed.png", resp.Header().Get("File-Path"))
+
+	info, err := s.Stat("resumed.png")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	_, err = s.StatVariant("resumed.png", "thumb")
+	assert.Nil(t, err)
+
+	// the upload is gone once stored
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = tusPatchRequest(s, location, len(content), nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = tusRequest(s, "POST", "/storage/tus/", nil, map[string]string{"Upload-Length": "10"})
+	location = resp.Header().Get("Location")
+	resp = tusRequest(s, "DELETE", location, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = tusRequest(s, "DELETE", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+// flakyBackend fails the first writes, like a storage coming back.
+type flakyBackend struct {
+	Backend
+	failures int
+}
+
+func (b *flakyBackend) Put(key string, r io.Reader) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("connection reset by peer")
+	}
+	return b.Backend.Put(key, r)
+}
+
+func TestTusRetry(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	backend := &flakyBackend{Backend: NewFsBackend(fs, "/images"), failures: 1}
+	uploads := afero.NewMemMapFs()
+	s := NewService(backend, Options{Uploads: uploads})
+
+	content := testPNG(16, 16)
+	resp := tusRequest(s, "POST", "/storage/tus/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("retried.png")),
+	})
+	location := resp.Header().Get("Location")
+
+	// a storage failure keeps the received bytes for a retry
+	resp = tusPatchRequest(s, location, 0, content)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header().Get("Upload-Offset"))
+
+	resp = tusPatchRequest(s, location, len(content), nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "/images/retried.png", resp.Header().Get("File-Path"))
+	infos, err := afero.ReadDir(uploads, "")
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}
+
+func TestTusExpire(t *testing.T) {
+	uploads := afero.NewMemMapFs()
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{Uploads: uploads, UploadExpiry: time.Hour})
+
+	resp := tusRequest(s, "POST", "/storage/tus/", nil, map[string]string{"Upload-Length": "10"})
+	location := resp.Header().Get("Location")
+	assert.Equal(t, http.StatusNoContent, tusPatchRequest(s, location, 0, []byte("part")).Code)
+	// a .bin left without its .info
+	assert.Nil(t, afero.WriteFile(uploads, newUUID()+".bin", nil, 0666))
+
+	assert.Nil(t, s.removeExpired(time.Now()))
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	assert.Nil(t, s.removeExpired(time.Now().Add(2*time.Hour)))
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	infos, err := afero.ReadDir(uploads, "")
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}
+
+func TestTusRejected(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Limits: Limits{MaxWidth: 1000, MaxHeight: 1000, MaxBytes: 1 << 10},
+	})
+
+	req, _ := http.NewRequest("POST", "/storage/tus/", nil)
+	req.Header.Set("Upload-Length", "10")
+	resp := performRequest(NewRouter(s), req)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.Code)
+	assert.Equal(t, "1.0.0", resp.Header().Get("Tus-Version"))
+
+	cases := []struct {
+		headers map[string]string
+		code    int
+	}{
+		{map[string]string{"Upload-Length": "2048"}, http.StatusRequestEntityTooLarge},
+		{map[string]string{"Upload-Length": "-1"}, http.StatusBadRequest},
+		{map[string]string{"Upload-Defer-Length": "1"}, http.StatusBadRequest},
+		{map[string]string{"Upload-Length": "10", "Upload-Metadata": "naming YmxhaA=="}, http.StatusBadRequest},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			resp := tusRequest(s, "POST", "/storage/tus/", nil, tc.headers)
+			assert.Equal(t, tc.code, resp.Code)
+		})
+	}
+
+	// content that is not an image is dropped once complete
+	resp = tusRequest(s, "POST", "/storage/tus/", nil, map[string]string{"Upload-Length": "12"})
+	location := resp.Header().Get("Location")
+	resp = tusPatchRequest(s, location, 0, []byte("not an image"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.Code)
+	resp = tusRequest(s, "HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = tusPatchRequest(s, "/storage/tus/../../etc/passwd", 0, nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
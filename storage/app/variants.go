@@ -0,0 +1,161 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Fit string
+
+const (
+	FitContain Fit = "contain"
+	FitCover   Fit = "cover"
+	FitExact   Fit = "exact"
+)
+
+// Variant is a named thumbnail preset, stored as <name>_<file name>.
+type Variant struct {
+	Name    string
+	Width   uint
+	Height  uint
+	Fit     Fit
+	Quality int
+}
+
+var DefaultVariants = []Variant{
+	{Name: "thumb", Width: 100, Height: 100, Fit: FitContain},
+}
+
+var variantNameRe = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// maxVariantNameLength keeps the links of variants, <variant>:<name>, of
+// the longest names within the 255 bytes of a file name.
+const maxVariantNameLength = 32
+
+// sourceVariant names the kept original of a converted upload.
+const sourceVariant = "source"
+
+func (v Variant) Validate() error {
+	if !variantNameRe.MatchString(v.Name) {
+		return fmt.Errorf("variant name %q should be lowercase letters and digits", v.Name)
+	}
+	if len(v.Name) > maxVariantNameLength {
+		return fmt.Errorf("variant name %q should be at most %d characters", v.Name, maxVariantNameLength)
+	}
+	if v.Name == sourceVariant {
+		return fmt.Errorf("variant name %q is reserved", v.Name)
+	}
+	if v.Width == 0 || v.Height == 0 {
+		return fmt.Errorf("variant %s: width and height should be positive", v.Name)
+	}
+	switch v.Fit {
+	case FitContain, FitCover, FitExact:
+	default:
+		return fmt.Errorf("variant %s: fit should be one of contain, cover, exact", v.Name)
+	}
+	if v.Quality < 0 || v.Quality > 100 {
+		return fmt.Errorf("variant %s: quality should be between 0 and 100, 0 is the default", v.Name)
+	}
+	return nil
+}
+
+func (v Variant) Apply(img image.Image) image.Image {
+	switch v.Fit {
+	case FitExact:
+		return resize.Resize(v.Width, v.Height, img, resize.Lanczos3)
+	case FitCover:
+		return cover(img, v.Width, v.Height)
+	default:
+		return resize.Thumbnail(v.Width, v.Height, img, resize.Lanczos3)
+	}
+}
+
+// ParseVariants reads presets written as name:WxH[:fit[:quality]] and
+// separated by commas, e.g. "thumb:100x100,cover:256x256:cover:80".
+func ParseVariants(spec string) ([]Variant, error) {
+	var variants []Variant
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ":")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("bad variant %q, expected name:WxH[:fit[:quality]]", item)
+		}
+		v := Variant{Name: fields[0], Fit: FitContain}
+		size := strings.Split(fields[1], "x")
+		if len(size) != 2 {
+			return nil, fmt.Errorf("bad variant size %q", fields[1])
+		}
+		w, errW := strconv.ParseUint(size[0], 10, 32)
+		h, errH := strconv.ParseUint(size[1], 10, 32)
+		if errW != nil || errH != nil {
+			return nil, fmt.Errorf("bad variant size %q", fields[1])
+		}
+		v.Width, v.Height = uint(w), uint(h)
+		if len(fields) > 2 && fields[2] != "" {
+			v.Fit = Fit(fields[2])
+		}
+		if len(fields) > 3 {
+			q, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("bad variant quality %q", fields[3])
+			}
+			v.Quality = q
+		}
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+		if seen[v.Name] {
+			return nil, fmt.Errorf("duplicate variant %s", v.Name)
+		}
+		seen[v.Name] = true
+		variants = append(variants, v)
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("no variants defined")
+	}
+	return variants, nil
+}
+
+// variantName is the name the variant of name is served under, below the
+// path of the original.
+func variantName(variant, name string) string {
+	return name + "/" + variant
+}
+
+// cover scales the image to fill w x h and crops the overflow evenly
+// from both sides.
+func cover(img image.Image, w, h uint) image.Image {
+	b := img.Bounds()
+	sw, sh := uint(b.Dx()), uint(b.Dy())
+	if sw == 0 || sh == 0 {
+		return img
+	}
+	rw, rh := w, sh*w/sw
+	if rh < h {
+		rw, rh = sw*h/sh, h
+	}
+	scaled := resize.Resize(rw, rh, img, resize.Lanczos3)
+
+	sb := scaled.Bounds()
+	x := sb.Min.X + (sb.Dx()-int(w))/2
+	y := sb.Min.Y + (sb.Dy()-int(h))/2
+	rect := image.Rect(x, y, x+int(w), y+int(h)).Intersect(sb)
+	if sub, ok := scaled.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), scaled, rect.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseVariants(t *testing.T) {
+	cases := []struct {
+		spec     string
+		variants []Variant
+		err      bool
+	}{
+		{
+			spec:     "thumb:100x100",
+			variants: []Variant{{Name: "thumb", Width: 100, Height: 100, Fit: FitContain}},
+		},
+		{
+			spec: "small:64x64:cover, large:2048x1024:exact:85",
+			variants: []Variant{
+				{Name: "small", Width: 64, Height: 64, Fit: FitCover},
+				{Name: "large", Width: 2048, Height: 1024, Fit: FitExact, Quality: 85},
+			},
+		},
+		{
+			spec:     "thumb:100x100:contain:0",
+			variants: []Variant{{Name: "thumb", Width: 100, Height: 100, Fit: FitContain}},
+		},
+		{spec: "", err: true},
+		{spec: "thumb", err: true},
+		{spec: "thumb:100", err: true},
+		{spec: "thumb:0x100", err: true},
+		{spec: "Thumb_1:100x100", err: true},
+		{spec: strings.Repeat("a", 33) + ":100x100", err: true},
+		{spec: "thumb:100x100:stretch", err: true},
+		{spec: "thumb:100x100:contain:101", err: true},
+		{spec: "thumb:100x100,thumb:200x200", err: true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			variants, err := ParseVariants(tc.spec)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.variants, variants)
+		})
+	}
+}
+
+func TestVariantApply(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	cases := []struct {
+		variant Variant
+		width   int
+		height  int
+	}{
+		{Variant{Width: 100, Height: 100, Fit: FitContain}, 100, 50},
+		{Variant{Width: 800, Height: 800, Fit: FitContain}, 400, 200},
+		{Variant{Width: 100, Height: 100, Fit: FitCover}, 100, 100},
+		{Variant{Width: 300, Height: 50, Fit: FitCover}, 300, 50},
+		{Variant{Width: 100, Height: 100, Fit: FitExact}, 100, 100},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			b := tc.variant.Apply(src).Bounds()
+			assert.Equal(t, tc.width, b.Dx())
+			assert.Equal(t, tc.height, b.Dy())
+		})
+	}
+}
+
+func TestServiceVariants(t *testing.T) {
+	s := NewService(NewFsBackend(afero.NewMemMapFs(), "/images"), Options{
+		Variants: []Variant{
+			{Name: "small", Width: 16, Height: 16, Fit: FitCover},
+			{Name: "medium", Width: 32, Height: 32, Fit: FitContain},
+		},
+	})
+	var buff bytes.Buffer
+	png.Encode(&buff, image.NewRGBA(image.Rect(0, 0, 64, 48)))
+
+	_, err := s.Save(File{Name: "v.png", Type: "image/png", Content: bytes.NewReader(buff.Bytes())})
+	assert.Nil(t, err)
+	paths, err := s.Variants(File{Name: "v.png", Type: "image/png", Content: bytes.NewReader(buff.Bytes())})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"small": "/images/v.png/small", "medium": "/images/v.png/medium"}, paths)
+	assert.Equal(t, "/images/v.png/small", s.ThumbnailPath("v.png"))
+
+	obj, _, err := s.OpenVariant("v.png", "medium")
+	assert.Nil(t, err)
+	img, err := png.Decode(obj)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 24), img.Bounds())
+
+	deleted, err := s.Delete("v.png")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/images/v.png/medium", "/images/v.png/small", "/images/v.png"}, deleted)
+}
+
+func TestVariantsLongName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	long := strings.Repeat("v", maxVariantNameLength)
+	s := NewService(NewFsBackend(afero.NewOsFs(), dir), Options{
+		Variants: []Variant{{Name: long, Width: 8, Height: 8, Fit: FitContain}},
+	})
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		content := testPNG(16+i, 16)
+		info, err := s.Save(File{
+			Name:      strings.Repeat("a", 300) + ".png",
+			Type:      "image/png",
+			Content:   bytes.NewReader(content),
+			Collision: CollisionRename,
+			Naming:    NamingOriginal,
+		})
+		assert.Nil(t, err)
+		paths, err := s.Variants(File{Name: info.Name, Type: "image/png", Content: bytes.NewReader(content)})
+		assert.Nil(t, err)
+		assert.Equal(t, s.path(info.Name)+"/"+long, paths[long])
+		names = append(names, info.Name)
+	}
+	assert.Len(t, names[0], maxNameLength)
+	assert.Equal(t, strings.TrimSuffix(names[0], ".png")+"-1.png", names[1])
+
+	// variants of names sharing a prefix stay apart
+	first, err := s.StatVariant(names[0], long)
+	assert.Nil(t, err)
+	second, err := s.StatVariant(names[1], long)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Hash, second.Hash)
+
+	deleted, err := s.Delete(names[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []string{s.path(names[0]) + "/" + long, s.path(names[0])}, deleted)
+	_, err = s.StatVariant(names[1], long)
+	assert.Nil(t, err)
+	_, err = s.backend.Stat(blobKey(first.Hash))
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"encoding/binary"
+)
+
+// decodableWebP rewrites an extended WebP the way the decoder reads one:
+// the image chunks alone, under a VP8X announcing nothing but alpha when
+// there is an ALPH chunk. Anything else, animations included, is returned
+// as it is.
+func decodableWebP(b []byte) []byte {
+	if len(b) < 16 || string(b[:4]) != "RIFF" || string(b[8:16]) != "WEBPVP8X" {
+		return b
+	}
+	var vp8x, alph, frame []byte
+	webpChunks(b, func(kind string, chunk, payload []byte) {
+		switch kind {
+		case "VP8X":
+			vp8x = append([]byte{}, payload...)
+		case "ALPH":
+			alph = webpChunk(kind, payload)
+		case "VP8 ", "VP8L":
+			frame = webpChunk(kind, payload)
+		}
+	})
+	if frame == nil || len(vp8x) != 10 {
+		return b
+	}
+	out := append([]byte{}, b[:12]...)
+	if alph != nil && string(frame[:4]) == "VP8 " {
+		vp8x[0] = webpFlagAlpha
+		out = append(out, webpChunk("VP8X", vp8x)...)
+		out = append(out, alph...)
+	}
+	out = append(out, frame...)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
@@ -1,13 +1,41 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
 	"staply/storage/app"
+	"syscall"
 )
 
 func main() {
-	router := app.NewRouter()
-	if err := router.Run(":8080"); err != nil {
+	config, err := app.LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
 		log.Fatalf("error: %v\n", err)
 	}
+	service, err := config.NewService()
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+	server := app.NewServer(config.Listen, service)
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("%v, waiting up to %v for uploads in flight\n", sig, config.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error: %v\n", err)
+		}
+		close(stopped)
+	}()
+
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+	<-stopped
 }